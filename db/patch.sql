@@ -8,10 +8,155 @@ INNER JOIN events e
 ON e.id = r.event_id
 SET r.price = e.price + s.price;
 
-ALTER TABLE events ADD s_remains INTEGER UNSIGNED NOT NULL;
-ALTER TABLE events ADD a_remains INTEGER UNSIGNED NOT NULL;
-ALTER TABLE events ADD b_remains INTEGER UNSIGNED NOT NULL;
-ALTER TABLE events ADD c_remains INTEGER UNSIGNED NOT NULL;
-
 ALTER TABLE reservations ADD INDEX reservation_index1 (reserved_at);
 ALTER TABLE reservations ADD COLUMN updated_at DATETIME(6) GENERATED ALWAYS AS (IFNULL(canceled_at, reserved_at)) PERSISTENT;
+
+ALTER TABLE reservations ADD COLUMN active_fg TINYINT(1) GENERATED ALWAYS AS (IF(canceled_at IS NULL, 1, NULL)) PERSISTENT;
+ALTER TABLE reservations ADD UNIQUE KEY event_id_sheet_id_active_uniq (event_id, sheet_id, active_fg);
+
+CREATE TABLE IF NOT EXISTS venues (
+    id          INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    name        VARCHAR(128)     NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT INTO venues (id, name) VALUES (1, 'default');
+
+ALTER TABLE sheets ADD venue_id INTEGER UNSIGNED NOT NULL DEFAULT 1 AFTER id;
+ALTER TABLE sheets DROP KEY rank_num_uniq, ADD UNIQUE KEY venue_id_rank_num_uniq (venue_id, `rank`, num);
+ALTER TABLE events ADD venue_id INTEGER UNSIGNED NOT NULL DEFAULT 1;
+
+CREATE TABLE IF NOT EXISTS waitlists (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id       INTEGER UNSIGNED NOT NULL,
+    `rank`         VARCHAR(128)     NOT NULL,
+    user_id        INTEGER UNSIGNED NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    reservation_id INTEGER UNSIGNED DEFAULT NULL,
+    promoted_at    DATETIME(6)      DEFAULT NULL,
+    KEY event_id_rank_idx (event_id, `rank`, reservation_id),
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id          VARCHAR(64)      PRIMARY KEY,
+    user_id     INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    data        BLOB             NOT NULL,
+    expires_at  DATETIME         NOT NULL,
+    KEY user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+ALTER TABLE reservations ADD INDEX event_id_reserved_at_idx (event_id, reserved_at);
+
+ALTER TABLE events ADD start_at DATETIME(6) DEFAULT NULL;
+ALTER TABLE events ADD sales_open_at DATETIME(6) DEFAULT NULL;
+ALTER TABLE events ADD sales_close_at DATETIME(6) DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS event_audits (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id         INTEGER UNSIGNED NOT NULL,
+    administrator_id INTEGER UNSIGNED NOT NULL,
+    field            VARCHAR(32)      NOT NULL,
+    old_value        VARCHAR(255)     NOT NULL,
+    new_value        VARCHAR(255)     NOT NULL,
+    created_at       DATETIME(6)      NOT NULL,
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE events ADD state VARCHAR(16) NOT NULL DEFAULT 'draft';
+UPDATE events SET state = CASE WHEN closed_fg THEN 'closed' WHEN public_fg THEN 'on_sale' ELSE 'draft' END;
+
+CREATE TABLE IF NOT EXISTS event_transitions (
+    id               INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id         INTEGER UNSIGNED NOT NULL,
+    from_state       VARCHAR(16)      NOT NULL,
+    to_state         VARCHAR(16)      NOT NULL,
+    administrator_id INTEGER UNSIGNED DEFAULT NULL,
+    created_at       DATETIME(6)      NOT NULL,
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE reservations ADD INDEX user_id_updated_at_idx (user_id, updated_at);
+
+ALTER TABLE events ADD max_per_user INTEGER UNSIGNED NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS event_rank_limits (
+    event_id     INTEGER UNSIGNED NOT NULL,
+    `rank`       VARCHAR(128)     NOT NULL,
+    max_per_user INTEGER UNSIGNED NOT NULL,
+    PRIMARY KEY (event_id, `rank`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS pricing_rules (
+    id            INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    event_id      INTEGER UNSIGNED NOT NULL,
+    `rank`        VARCHAR(128)     DEFAULT NULL,
+    kind          VARCHAR(16)      NOT NULL,
+    amount        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    percent       INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    until         DATETIME(6)      DEFAULT NULL,
+    remains_below INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    KEY event_id_idx (event_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id                INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    code              VARCHAR(32)      NOT NULL,
+    kind              VARCHAR(16)      NOT NULL,
+    amount            INTEGER UNSIGNED NOT NULL,
+    max_uses          INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    max_uses_per_user INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    used_count        INTEGER UNSIGNED NOT NULL DEFAULT 0,
+    valid_from        DATETIME(6)      DEFAULT NULL,
+    valid_until       DATETIME(6)      DEFAULT NULL,
+    event_id          INTEGER UNSIGNED DEFAULT NULL,
+    `rank`            VARCHAR(128)     DEFAULT NULL,
+    UNIQUE KEY code_uniq (code)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS promo_redemptions (
+    id            INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    promo_code_id INTEGER UNSIGNED NOT NULL,
+    user_id       INTEGER UNSIGNED NOT NULL,
+    event_id      INTEGER UNSIGNED NOT NULL,
+    created_at    DATETIME(6)      NOT NULL,
+    KEY promo_code_id_user_id_idx (promo_code_id, user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE reservations ADD discount INTEGER UNSIGNED NOT NULL DEFAULT 0;
+ALTER TABLE reservations ADD promo_code_id INTEGER UNSIGNED DEFAULT NULL;
+
+CREATE TABLE IF NOT EXISTS reservation_transfers (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    from_user_id   INTEGER UNSIGNED NOT NULL,
+    to_user_id     INTEGER UNSIGNED NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    accepted_at    DATETIME(6)      DEFAULT NULL,
+    canceled_at    DATETIME(6)      DEFAULT NULL,
+    KEY reservation_id_idx (reservation_id),
+    KEY from_user_id_idx (from_user_id),
+    KEY to_user_id_idx (to_user_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS resale_listings (
+    id             INTEGER UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+    reservation_id INTEGER UNSIGNED NOT NULL,
+    seller_id      INTEGER UNSIGNED NOT NULL,
+    price          INTEGER UNSIGNED NOT NULL,
+    created_at     DATETIME(6)      NOT NULL,
+    buyer_id       INTEGER UNSIGNED DEFAULT NULL,
+    sold_at        DATETIME(6)      DEFAULT NULL,
+    canceled_at    DATETIME(6)      DEFAULT NULL,
+    KEY reservation_id_idx (reservation_id),
+    KEY sold_at_idx (sold_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE reservations ADD checked_in_at DATETIME(6) DEFAULT NULL;
+
+ALTER TABLE reservations ADD original_user_id INTEGER UNSIGNED NOT NULL DEFAULT 0;
+UPDATE reservations SET original_user_id = user_id;
+
+ALTER TABLE sessions ADD KEY expires_at_idx (expires_at);
+
+DELETE w FROM waitlists w JOIN waitlists w2 ON w2.event_id = w.event_id AND w2.`rank` = w.`rank` AND w2.user_id = w.user_id AND w2.reservation_id IS NULL AND w2.id < w.id WHERE w.reservation_id IS NULL;
+ALTER TABLE waitlists ADD COLUMN active_fg TINYINT(1) GENERATED ALWAYS AS (IF(reservation_id IS NULL, 1, NULL)) PERSISTENT;
+ALTER TABLE waitlists ADD UNIQUE KEY event_id_rank_user_id_active_uniq (event_id, `rank`, user_id, active_fg);
@@ -3,3 +3,7 @@ DB_HOST=127.0.0.1
 DB_PORT=3306
 DB_USER=isucon
 DB_PASS=isucon
+HOLD_TTL=10m
+PASSWORD_HASHER=bcrypt
+SESSION_STORE=cookie
+SESSION_MAX_AGE=3600
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -13,20 +12,16 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/felixge/fgprof"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
-const TotalSheets = 1000
-
 type User struct {
 	ID        int64  `json:"id,omitempty"`
 	Nickname  string `json:"nickname,omitempty"`
@@ -40,10 +35,20 @@ type Event struct {
 	PublicFg bool   `json:"public,omitempty"`
 	ClosedFg bool   `json:"closed,omitempty"`
 	Price    int64  `json:"price,omitempty"`
-	SRemains int
-	ARemains int
-	BRemains int
-	CRemains int
+	VenueID  int64  `json:"venue_id,omitempty"`
+	State    string `json:"state,omitempty"`
+
+	MaxPerUser int64            `json:"max_per_user,omitempty"`
+	RankLimits map[string]int64 `json:"rank_limits,omitempty"`
+
+	StartAt      *time.Time `json:"-"`
+	SalesOpenAt  *time.Time `json:"-"`
+	SalesCloseAt *time.Time `json:"-"`
+
+	Venue            string `json:"venue,omitempty"`
+	StartAtUnix      int64  `json:"start_at,omitempty"`
+	SalesOpenAtUnix  int64  `json:"sales_open_at,omitempty"`
+	SalesCloseAtUnix int64  `json:"sales_close_at,omitempty"`
 
 	Total   int                `json:"total"`
 	Remains int                `json:"remains"`
@@ -70,22 +75,61 @@ type Sheet struct {
 }
 
 type Reservation struct {
-	ID         int64      `json:"id"`
-	EventID    int64      `json:"-"`
-	SheetID    int64      `json:"-"`
-	UserID     int64      `json:"-"`
-	ReservedAt *time.Time `json:"-"`
-	CanceledAt *time.Time `json:"-"`
-	UpdatedAt  *time.Time `json:"-"`
+	ID          int64      `json:"id"`
+	EventID     int64      `json:"-"`
+	SheetID     int64      `json:"-"`
+	UserID      int64      `json:"-"`
+	ReservedAt  *time.Time `json:"-"`
+	CanceledAt  *time.Time `json:"-"`
+	UpdatedAt   *time.Time `json:"-"`
+	PromoCodeID *int64     `json:"-"`
 
 	Event          *Event `json:"event,omitempty"`
 	SheetRank      string `json:"sheet_rank,omitempty"`
 	SheetNum       int64  `json:"sheet_num,omitempty"`
 	Price          int64  `json:"price,omitempty"`
+	Discount       int64  `json:"discount,omitempty"`
+	Transferred    bool   `json:"transferred,omitempty"`
+	Ticket         string `json:"ticket,omitempty"`
 	ReservedAtUnix int64  `json:"reserved_at,omitempty"`
 	CanceledAtUnix int64  `json:"canceled_at,omitempty"`
 }
 
+const eventColumns = "id, title, public_fg, closed_fg, price, venue_id, start_at, sales_open_at, sales_close_at, state, max_per_user"
+
+// columns returns the scan destinations matching eventColumns.
+func (e *Event) columns() []interface{} {
+	return []interface{}{&e.ID, &e.Title, &e.PublicFg, &e.ClosedFg, &e.Price, &e.VenueID, &e.StartAt, &e.SalesOpenAt, &e.SalesCloseAt, &e.State, &e.MaxPerUser}
+}
+
+func scanEvent(s rowScanner, e *Event) error {
+	return s.Scan(e.columns()...)
+}
+
+const reservationColumns = "id, event_id, sheet_id, user_id, reserved_at, canceled_at, price, updated_at, discount, promo_code_id"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// columns returns the scan destinations matching reservationColumns.
+func (r *Reservation) columns() []interface{} {
+	return []interface{}{&r.ID, &r.EventID, &r.SheetID, &r.UserID, &r.ReservedAt, &r.CanceledAt, &r.Price, &r.UpdatedAt, &r.Discount, &r.PromoCodeID}
+}
+
+func scanReservation(s rowScanner, r *Reservation) error {
+	return s.Scan(r.columns()...)
+}
+
+// qualify prefixes every column of a comma separated list with a table alias.
+func qualify(alias, columns string) string {
+	list := strings.Split(columns, ", ")
+	for i, c := range list {
+		list[i] = alias + "." + c
+	}
+	return strings.Join(list, ", ")
+}
+
 type Administrator struct {
 	ID        int64  `json:"id,omitempty"`
 	Nickname  string `json:"nickname,omitempty"`
@@ -104,22 +148,14 @@ func sessUserID(c echo.Context) int64 {
 
 func sessSetUserID(c echo.Context, id int64) {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
-	}
+	sess.Options = sessionOptions()
 	sess.Values["user_id"] = id
 	sess.Save(c.Request(), c.Response())
 }
 
 func sessDeleteUserID(c echo.Context) {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
-	}
+	sess.Options = sessionOptions()
 	delete(sess.Values, "user_id")
 	sess.Save(c.Request(), c.Response())
 }
@@ -135,22 +171,14 @@ func sessAdministratorID(c echo.Context) int64 {
 
 func sessSetAdministratorID(c echo.Context, id int64) {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
-	}
+	sess.Options = sessionOptions()
 	sess.Values["administrator_id"] = id
 	sess.Save(c.Request(), c.Response())
 }
 
 func sessDeleteAdministratorID(c echo.Context) {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
-	}
+	sess.Options = sessionOptions()
 	delete(sess.Values, "administrator_id")
 	sess.Save(c.Request(), c.Response())
 }
@@ -194,137 +222,147 @@ func getLoginAdministrator(c echo.Context) (*Administrator, error) {
 }
 
 func getEvents(all bool) ([]*Event, error) {
-	var query string
-	if all {
-		query = `SELECT * FROM events ORDER BY id ASC`
-	} else {
-		query = `SELECT * FROM events WHERE public_fg = TRUE ORDER BY id ASC`
+	q := &EventQuery{Sort: "id"}
+	if !all {
+		q.States = visibleStates
 	}
+	events, _, err := findEvents(q)
+	return events, err
+}
 
-	rows, err := db.Query(query)
+// findEvents returns the page of events selected by q with their sheet
+// counts, and the cursor of the next page if there is one.
+func findEvents(q *EventQuery) ([]*Event, string, error) {
+	query, args := q.sql()
+	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	defer rows.Close()
 
-	var events []*Event
+	events := []*Event{}
+	var eventIDs []int64
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.SRemains, &event.ARemains, &event.BRemains, &event.CRemains); err != nil {
-			return nil, err
+		if err := scanEvent(rows, &event); err != nil {
+			return nil, "", err
 		}
-		event.Total = TotalSheets
-		event.Remains = event.SRemains + event.ARemains + event.BRemains + event.CRemains
-		event.Sheets = map[string]*Sheets{
-			"S": {
-				Total:   sheetsTotal["S"],
-				Price:   event.Price + sheetsPrice["S"],
-				Remains: event.SRemains,
-			},
-			"A": {
-				Total:   sheetsTotal["A"],
-				Price:   event.Price + sheetsPrice["A"],
-				Remains: event.ARemains,
-			},
-			"B": {
-				Total:   sheetsTotal["B"],
-				Price:   event.Price + sheetsPrice["B"],
-				Remains: event.BRemains,
-			},
-			"C": {
-				Total:   sheetsTotal["C"],
-				Price:   event.Price + sheetsPrice["C"],
-				Remains: event.CRemains,
-			},
-		}
-
 		events = append(events, &event)
+		eventIDs = append(eventIDs, event.ID)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	rows.Close()
 
-	return events, nil
-}
-
-func getEventsOld(all bool) ([]*Event, error) {
-	rows, err := db.Query("SELECT * FROM events ORDER BY id ASC")
+	rules, err := loadEventsPricingRules(db, eventIDs)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	defer rows.Close()
-
-	var events []*Event
-	for rows.Next() {
-		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.SRemains, &event.ARemains, &event.BRemains, &event.CRemains); err != nil {
-			return nil, err
+	now := time.Now()
+	for _, event := range events {
+		venue, ok := getVenue(event.VenueID)
+		if !ok {
+			return nil, "", fmt.Errorf("event %d: unknown venue %d", event.ID, event.VenueID)
 		}
-		if !all && !event.PublicFg {
-			continue
-		}
-		events = append(events, &event)
-	}
-	for i, v := range events {
-		event, err := getEvent(v.ID, -1)
+		remains, err := inventory.Remains(event.ID)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		for k := range event.Sheets {
-			event.Sheets[k].Detail = nil
+		pricer := &Pricer{event: event, rules: rules[event.ID]}
+
+		event.fillSchedule()
+		event.Sheets = make(map[string]*Sheets, len(venue.Ranks))
+		for _, r := range venue.Ranks {
+			event.Sheets[r.Rank] = &Sheets{
+				Total:   r.Total,
+				Price:   pricer.Price(r.Rank, r.Price, remains[r.Rank], now),
+				Remains: remains[r.Rank],
+			}
+			event.Remains += remains[r.Rank]
 		}
-		events[i] = event
+		event.Total = venue.Total
+	}
+
+	var next string
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+		next = q.cursorAfter(events[len(events)-1])
 	}
-	return events, nil
+	return events, next, nil
 }
 
 func getEvent(eventID, loginUserID int64) (*Event, error) {
 	var event Event
-	if err := db.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.SRemains, &event.ARemains, &event.BRemains, &event.CRemains); err != nil {
+	if err := scanEvent(db.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", eventID), &event); err != nil {
 		return nil, err
 	}
-	event.Sheets = map[string]*Sheets{
-		"S": &Sheets{},
-		"A": &Sheets{},
-		"B": &Sheets{},
-		"C": &Sheets{},
+	return makeEvent(event, loginUserID)
+}
+
+// makeEvent fills in the sheets of the event from its venue layout and the
+// inventory, marking the sheets reserved by loginUserID as mine.
+func makeEvent(event Event, loginUserID int64) (*Event, error) {
+	snapshot, err := inventory.Snapshot(event.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	sheeetIDReservation := map[int64]*Reservation{}
-	rows, err := db.Query("SELECT * FROM reservations WHERE event_id = ? AND canceled_at IS NULL GROUP BY event_id, sheet_id HAVING reserved_at = MIN(reserved_at)", event.ID)
+	sheetIDReservation := map[int64]*Reservation{}
+	rows, err := db.Query("SELECT "+reservationColumns+" FROM reservations WHERE event_id = ? AND canceled_at IS NULL", event.ID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var reservation Reservation
-		err = rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt)
-		if err != nil {
+		if err := scanReservation(rows, &reservation); err != nil {
 			return nil, err
 		}
-		sheeetIDReservation[reservation.SheetID] = &reservation
+		sheetIDReservation[reservation.SheetID] = &reservation
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	rows, err = db.Query("SELECT * FROM sheets ORDER BY `rank`, num")
+	if event.RankLimits, err = loadRankLimits(db, event.ID); err != nil {
+		return nil, err
+	}
+	pricer, err := newPricer(db, &event)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	now := time.Now()
+	venue, ok := getVenue(event.VenueID)
+	if !ok {
+		return nil, fmt.Errorf("event %d: unknown venue %d", event.ID, event.VenueID)
+	}
 
-	for rows.Next() {
-		var sheet Sheet
-		if err := rows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			return nil, err
+	event.fillSchedule()
+	event.Sheets = make(map[string]*Sheets, len(snapshot))
+	for rank, rs := range snapshot {
+		sheets := &Sheets{
+			Total:   len(rs.Sheets),
+			Remains: rs.Remains,
+			Detail:  make([]*Sheet, 0, len(rs.Sheets)),
 		}
-		event.Sheets[sheet.Rank].Price = event.Price + sheet.Price
-		event.Total++
-		event.Sheets[sheet.Rank].Total++
-
-		if reservation, ok := sheeetIDReservation[sheet.ID]; ok {
-			sheet.Mine = reservation.UserID == loginUserID
-			sheet.Reserved = true
-			sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
-		} else {
-			event.Remains++
-			event.Sheets[sheet.Rank].Remains++
+		if r, ok := venue.Rank(rank); ok {
+			sheets.Price = pricer.Price(rank, r.Price, rs.Remains, now)
 		}
-
-		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
+		for i, s := range rs.Sheets {
+			sheet := *s
+			if !rs.Free(i) {
+				sheet.Reserved = true
+				if reservation, ok := sheetIDReservation[sheet.ID]; ok {
+					sheet.Mine = reservation.UserID == loginUserID
+					sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
+				}
+			}
+			sheets.Detail = append(sheets.Detail, &sheet)
+		}
+		event.Sheets[rank] = sheets
+		event.Total += sheets.Total
+		event.Remains += sheets.Remains
 	}
 
 	return &event, nil
@@ -356,10 +394,13 @@ func fillinAdministrator(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-func validateRank(rank string) bool {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM sheets WHERE `rank` = ?", rank).Scan(&count)
-	return count > 0
+func validateRank(event *Event, rank string) bool {
+	venue, ok := getVenue(event.VenueID)
+	if !ok {
+		return false
+	}
+	_, ok = venue.Rank(rank)
+	return ok
 }
 
 type Renderer struct {
@@ -394,6 +435,20 @@ func main() {
 		log.Fatal(err)
 	}
 
+	holds = NewHoldStore(envDuration("HOLD_TTL", 10*time.Minute))
+	if err := setPasswordHasher(); err != nil {
+		log.Fatal(err)
+	}
+	if sessionConf, err = loadSessionConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if sessionStore, err = newSessionStore(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setTicketSecret(); err != nil {
+		log.Fatal(err)
+	}
+
 	e := echo.New()
 	funcs := template.FuncMap{
 		"encode_json": func(v interface{}) string {
@@ -406,7 +461,7 @@ func main() {
 		templates: template.Must(template.New("").Delims("[[", "]]").Funcs(funcs).ParseGlob("views/*.tmpl")),
 	}
 
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.Use(session.Middleware(sessionStore))
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Output: os.Stderr}))
 	e.GET("/", func(c echo.Context) error {
 		events, err := getEvents(false)
@@ -432,19 +487,39 @@ func main() {
 			return nil
 		}
 
-		setRemains()
-		setEventsRemains()
+		if err := setVenues(); err != nil {
+			return err
+		}
+		holds.Reset()
+		if err := inventory.Load(); err != nil {
+			return err
+		}
 
 		return c.NoContent(204)
 	})
 	e.POST("/api/users", addUserHandler)
 	e.GET("/api/users/:id", getUserHandler, loginRequired)
+	e.GET("/api/users/:id/reservations", getUserReservationsHandler, loginRequired)
 	e.POST("/api/actions/login", loginHandler)
 	e.POST("/api/actions/logout", logoutHandler, loginRequired)
 	e.GET("/api/events", getEventsHandler)
 	e.GET("/api/events/:id", getEventHandler)
 	e.POST("/api/events/:id/actions/reserve", addReservationHandler, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/:num/reservation", addSheetReservationHandler, loginRequired)
 	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", removeReservationHandler, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/:num/resale", addResaleHandler, loginRequired)
+	e.POST("/api/events/:id/sheets/:rank/:num/transfer", addTransferHandler, loginRequired)
+	e.GET("/api/events/:id/resales", getResalesHandler)
+	e.POST("/api/events/:id/waitlist", addWaitlistHandler, loginRequired)
+	e.DELETE("/api/events/:id/waitlist/:rank", removeWaitlistHandler, loginRequired)
+	e.POST("/api/events/:id/holds", addHoldHandler, loginRequired)
+	e.POST("/api/holds/:id/actions/confirm", confirmHoldHandler, loginRequired)
+	e.DELETE("/api/holds/:id", removeHoldHandler, loginRequired)
+	e.POST("/api/resales/:id/actions/buy", buyResaleHandler, loginRequired)
+	e.DELETE("/api/resales/:id", removeResaleHandler, loginRequired)
+	e.GET("/api/transfers", getTransfersHandler, loginRequired)
+	e.POST("/api/transfers/:id/actions/accept", acceptTransferHandler, loginRequired)
+	e.DELETE("/api/transfers/:id", removeTransferHandler, loginRequired)
 	e.GET("/admin/", getAdminHandler, fillinAdministrator)
 	e.POST("/admin/api/actions/login", loginAdminHandler)
 	e.POST("/admin/api/actions/logout", logoutAdminHandler, adminLoginRequired)
@@ -452,39 +527,41 @@ func main() {
 	e.POST("/admin/api/events", addAdminEventHandler, adminLoginRequired)
 	e.GET("/admin/api/events/:id", getAdminEventHandler, adminLoginRequired)
 	e.POST("/admin/api/events/:id/actions/edit", editAdminEventHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/audits", getAdminEventAuditsHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/transition", transitionAdminEventHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/check_in", checkInAdminEventHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/actions/cancel", cancelAdminEventHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/pricing_rules", getAdminPricingRulesHandler, adminLoginRequired)
+	e.POST("/admin/api/events/:id/pricing_rules", addAdminPricingRuleHandler, adminLoginRequired)
+	e.DELETE("/admin/api/events/:id/pricing_rules/:rule_id", removeAdminPricingRuleHandler, adminLoginRequired)
+	e.GET("/admin/api/events/:id/transitions", getAdminEventTransitionsHandler, adminLoginRequired)
+	e.GET("/admin/api/promo_codes", getAdminPromoCodesHandler, adminLoginRequired)
+	e.POST("/admin/api/promo_codes", addAdminPromoCodeHandler, adminLoginRequired)
+	e.GET("/admin/api/promo_codes/:id", getAdminPromoCodeHandler, adminLoginRequired)
+	e.POST("/admin/api/promo_codes/:id/actions/edit", editAdminPromoCodeHandler, adminLoginRequired)
+	e.DELETE("/admin/api/promo_codes/:id", removeAdminPromoCodeHandler, adminLoginRequired)
+	e.GET("/admin/api/reports/events/:id/attendance", getEventAttendanceHandler, adminLoginRequired)
 	e.GET("/admin/api/reports/events/:id/sales", getReportHandler, adminLoginRequired)
+	e.GET("/admin/api/reports/events/:id/revenue", getEventRevenueHandler, adminLoginRequired)
 	e.GET("/admin/api/reports/sales", getReportsHandler, adminLoginRequired)
+	e.GET("/admin/api/reports/revenue", getRevenueHandler, adminLoginRequired)
+	e.POST("/admin/api/users/:id/actions/revoke_sessions", revokeAdminUserSessionsHandler, adminLoginRequired)
+	e.GET("/admin/api/venues", getAdminVenuesHandler, adminLoginRequired)
+	e.POST("/admin/api/venues", addAdminVenueHandler, adminLoginRequired)
+	e.GET("/admin/api/venues/:id", getAdminVenueHandler, adminLoginRequired)
 
-	setSeets()
-	setEventsRemains()
-
-	e.Start(":8080")
-}
-
-type Report struct {
-	ReservationID int64
-	EventID       int64
-	Rank          string
-	Num           int64
-	UserID        int64
-	SoldAt        string
-	CanceledAt    string
-	Price         int64
-}
-
-func renderReportCSV(c echo.Context, reports []Report) error {
-	sort.Slice(reports, func(i, j int) bool { return strings.Compare(reports[i].SoldAt, reports[j].SoldAt) < 0 })
-
-	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
-	for _, v := range reports {
-		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
-			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
+	if err := setVenues(); err != nil {
+		log.Fatal(err)
+	}
+	if err := inventory.Load(); err != nil {
+		log.Fatal(err)
+	}
+	go holds.Sweep(time.Second)
+	if store, ok := sessionStore.(*ServerSessionStore); ok {
+		go store.Sweep(time.Minute)
 	}
 
-	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
-	c.Response().Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
-	_, err := io.Copy(c.Response(), body)
-	return err
+	e.Start(":8080")
 }
 
 func resError(c echo.Context, e string, status int) error {
@@ -497,145 +574,16 @@ func resError(c echo.Context, e string, status int) error {
 	return c.JSON(status, map[string]string{"error": e})
 }
 
-var sheets map[int64]Sheet
-
-var sheetsTotal map[string]int
-var sheetsPrice map[string]int64
-
-var eventsRemains map[int64]int
-
-func setEventsRemains() {
-	eventsRemains = map[int64]int{}
-	rows, _ := db.Query(`SELECT id FROM events`)
-	for rows.Next() {
-		var eventID int
-		rows.Scan(&eventID)
-		eventsRemains[int64(eventID)] = TotalSheets
-	}
-
-	rows, _ = db.Query(`
-	SELECT event_id FROM reservations WHERE canceled_at IS NULL`)
-	for rows.Next() {
-		var eventID int64
-		rows.Scan(&eventID)
-		eventsRemains[eventID]--
-	}
-}
-
-func setSeets() {
-	sheets = map[int64]Sheet{}
-	sheetsTotal = map[string]int{
-		"S": 0,
-		"A": 0,
-		"B": 0,
-		"C": 0,
+// envDuration reads a duration such as "90s" from the environment.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
 	}
-	sheetsPrice = map[string]int64{
-		"S": 0,
-		"A": 0,
-		"B": 0,
-		"C": 0,
-	}
-
-	rows, err := db.Query(`SELECT * FROM sheets`)
+	d, err := time.ParseDuration(v)
 	if err != nil {
-		fmt.Println(err)
-		panic(err)
-	}
-
-	for rows.Next() {
-		var s Sheet
-		err = rows.Scan(&s.ID, &s.Rank, &s.Num, &s.Price)
-		sheets[s.ID] = s
-
-		sheetsTotal[s.Rank]++
-		sheetsPrice[s.Rank] = s.Price
-	}
-
-	err = rows.Close()
-	if err != nil {
-		fmt.Println(err)
-		panic(err)
-	}
-}
-
-func makeEvent(event Event, userID int64) (*Event, error) {
-	event.Sheets = map[string]*Sheets{
-		"S": {
-			Total:   sheetsTotal["S"],
-			Price:   event.Price + sheetsPrice["S"],
-			Remains: sheetsTotal["S"],
-		},
-		"A": {
-			Total:   sheetsTotal["A"],
-			Price:   event.Price + sheetsPrice["A"],
-			Remains: sheetsTotal["A"],
-		},
-		"B": {
-			Total:   sheetsTotal["B"],
-			Price:   event.Price + sheetsPrice["B"],
-			Remains: sheetsTotal["B"],
-		},
-		"C": {
-			Total:   sheetsTotal["C"],
-			Price:   event.Price + sheetsPrice["C"],
-			Remains: sheetsTotal["C"],
-		},
-	}
-
-	rows, err := db.Query("SELECT * FROM reservations WHERE event_id = ? AND canceled_at IS NULL", event.ID)
-	if err != nil {
-		return nil, err
-	}
-
-	addedSheetsIDs := map[int64]struct{}{}
-
-	for rows.Next() {
-		var reservation Reservation
-		err = rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-
-		sheet := sheets[reservation.SheetID]
-		sheet.Mine = reservation.UserID == userID
-		sheet.Reserved = true
-		sheet.ReservedAtUnix = reservation.ReservedAt.Unix()
-
-		event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
-		event.Sheets[sheet.Rank].Remains--
-		event.Total++
-
-		addedSheetsIDs[reservation.SheetID] = struct{}{}
-	}
-
-	for _, sheet := range sheets {
-		if _, ok := addedSheetsIDs[sheet.ID]; !ok {
-			event.Sheets[sheet.Rank].Detail = append(event.Sheets[sheet.Rank].Detail, &sheet)
-			event.Total++
-			event.Remains++
-		}
-	}
-
-	return &event, nil
-}
-
-func setRemains() {
-	events, err := getEventsOld(true)
-	if err != nil {
-		fmt.Println(err)
-		panic(err)
-	}
-	for _, e := range events {
-		_, err := db.Exec(`
-		UPDATE events
-		SET s_remains = ?, a_remains = ?, b_remains = ?, c_remains = ?
-		WHERE id = ?`,
-			e.Sheets["S"].Remains, e.Sheets["A"].Remains, e.Sheets["B"].Remains, e.Sheets["C"].Remains,
-			e.ID)
-		if err != nil {
-			fmt.Println(err)
-			panic(err)
-		}
+		log.Printf("invalid %s=%q: %v", key, v, err)
+		return def
 	}
+	return d
 }
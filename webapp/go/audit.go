@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EventAudit records one field of an event changed by an administrator.
+// Values are stored as text; unset times are empty.
+type EventAudit struct {
+	ID              int64      `json:"id"`
+	EventID         int64      `json:"event_id"`
+	AdministratorID int64      `json:"administrator_id"`
+	Field           string     `json:"field"`
+	OldValue        string     `json:"old_value"`
+	NewValue        string     `json:"new_value"`
+	CreatedAt       *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+// diffEvents lists the audited fields that differ between two versions of
+// an event. State changes are recorded as transitions instead.
+func diffEvents(old, new *Event) []EventAudit {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	type field struct {
+		name     string
+		old, new string
+	}
+	fields := []field{
+		{"title", old.Title, new.Title},
+		{"price", strconv.FormatInt(old.Price, 10), strconv.FormatInt(new.Price, 10)},
+		{"venue_id", strconv.FormatInt(old.VenueID, 10), strconv.FormatInt(new.VenueID, 10)},
+		{"start_at", formatTime(old.StartAt), formatTime(new.StartAt)},
+		{"sales_open_at", formatTime(old.SalesOpenAt), formatTime(new.SalesOpenAt)},
+		{"sales_close_at", formatTime(old.SalesCloseAt), formatTime(new.SalesCloseAt)},
+		{"max_per_user", strconv.FormatInt(old.MaxPerUser, 10), strconv.FormatInt(new.MaxPerUser, 10)},
+	}
+	ranks := map[string]bool{}
+	for rank := range old.RankLimits {
+		ranks[rank] = true
+	}
+	for rank := range new.RankLimits {
+		ranks[rank] = true
+	}
+	rankNames := make([]string, 0, len(ranks))
+	for rank := range ranks {
+		rankNames = append(rankNames, rank)
+	}
+	sort.Strings(rankNames)
+	for _, rank := range rankNames {
+		fields = append(fields, field{"rank_limit:" + rank, strconv.FormatInt(old.RankLimits[rank], 10), strconv.FormatInt(new.RankLimits[rank], 10)})
+	}
+
+	var audits []EventAudit
+	for _, f := range fields {
+		if f.old != f.new {
+			audits = append(audits, EventAudit{EventID: old.ID, Field: f.name, OldValue: f.old, NewValue: f.new})
+		}
+	}
+	return audits
+}
+
+func insertEventAudits(tx *sql.Tx, administratorID int64, audits []EventAudit) error {
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+	for _, a := range audits {
+		if _, err := tx.Exec("INSERT INTO event_audits (event_id, administrator_id, field, old_value, new_value, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			a.EventID, administratorID, a.Field, a.OldValue, a.NewValue, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getAdminEventAuditsHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	rows, err := db.Query("SELECT id, event_id, administrator_id, field, old_value, new_value, created_at FROM event_audits WHERE event_id = ? ORDER BY id ASC", eventID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	audits := make([]EventAudit, 0)
+	for rows.Next() {
+		var a EventAudit
+		if err := rows.Scan(&a.ID, &a.EventID, &a.AdministratorID, &a.Field, &a.OldValue, &a.NewValue, &a.CreatedAt); err != nil {
+			return err
+		}
+		a.CreatedAtUnix = a.CreatedAt.Unix()
+		audits = append(audits, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, audits)
+}
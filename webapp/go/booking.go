@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errNotReserved = errors.New("reservation: sheet not reserved")
+	errNotOwner    = errors.New("reservation: reserved by another user")
+)
+
+// maxSheetsPerReservation caps the quantity of a single reserve request.
+const maxSheetsPerReservation = 20
+
+type ReservedSheet struct {
+	ID       int64 `json:"id"`
+	SheetNum int64 `json:"sheet_num"`
+	Price    int64 `json:"price"`
+	Discount int64 `json:"discount,omitempty"`
+}
+
+// Charge is what a reservation is sold for: Price is paid after Discount
+// was taken off by the promo code PromoCodeID.
+type Charge struct {
+	Price       int64
+	Discount    int64
+	PromoCodeID int64
+}
+
+// insertReservations stores one reservation per sheet in a single
+// transaction, while the event is still selling and within its purchase
+// limits. The sheets must already be taken from the inventory; the caller
+// releases them if this fails. Each sheet is charged the price quoted as if
+// the sheets of the purchase were still free, less the discount of promoCode
+// if one is given.
+func insertReservations(event *Event, userID int64, sheets []*Sheet, promoCode string) ([]ReservedSheet, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	reservedAt := time.Now().UTC()
+	if event, err = lockSellingEvent(tx, event, reservedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := checkPurchaseLimits(tx, event, userID, sheets); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	pricer, err := newPricer(tx, event)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	remains, err := inventory.Remains(event.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, sheet := range sheets {
+		remains[sheet.Rank]++
+	}
+
+	var promo *PromoCode
+	if promoCode != "" {
+		if promo, err = redeemPromoCode(tx, promoCode, event, userID, sheets, reservedAt); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	reserved := make([]ReservedSheet, 0, len(sheets))
+	for _, sheet := range sheets {
+		charge := Charge{Price: pricer.Price(sheet.Rank, sheet.Price, remains[sheet.Rank], reservedAt)}
+		if promo != nil {
+			charge.Discount = promo.Discount(charge.Price)
+			charge.Price -= charge.Discount
+			charge.PromoCodeID = promo.ID
+		}
+		reservationID, err := insertReservation(tx, event, userID, sheet, charge, reservedAt)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		reserved = append(reserved, ReservedSheet{ID: reservationID, SheetNum: sheet.Num, Price: charge.Price, Discount: charge.Discount})
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return reserved, nil
+}
+
+// lockSellingEvent re-reads the event inside tx and keeps a shared lock on
+// it until tx ends, so it cannot be paused, closed or rescheduled while
+// sheets are being sold. It fails unless the event is still selling at now.
+func lockSellingEvent(tx *sql.Tx, event *Event, now time.Time) (*Event, error) {
+	locked := *event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ? LOCK IN SHARE MODE", event.ID), &locked); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errEventHidden
+		}
+		return nil, err
+	}
+	if !locked.visible() {
+		return nil, errEventHidden
+	}
+	if err := locked.checkSelling(now); err != nil {
+		return nil, err
+	}
+	return &locked, nil
+}
+
+// insertReservation stores a reservation sold for charge. The charge is
+// kept as sold even if the event's pricing changes later.
+func insertReservation(tx *sql.Tx, event *Event, userID int64, sheet *Sheet, charge Charge, reservedAt time.Time) (int64, error) {
+	res, err := tx.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, original_user_id, reserved_at, price, discount, promo_code_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		event.ID, sheet.ID, userID, userID, reservedAt.Format("2006-01-02 15:04:05.000000"), charge.Price, charge.Discount, nullInt64(charge.PromoCodeID))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// resBookingError responds to a failure of insertReservations.
+func resBookingError(c echo.Context, err error) error {
+	switch err {
+	case errLimitExceeded:
+		return resError(c, "limit_exceeded", 409)
+	case errPromoInvalid:
+		return resError(c, "invalid_promo_code", 400)
+	case errPromoExhausted:
+		return resError(c, "promo_code_exhausted", 409)
+	case errEventHidden:
+		return resError(c, "invalid_event", 404)
+	case errSalesPaused, errSalesNotOpen, errSalesClosed:
+		return resSalesWindowError(c, err)
+	}
+	return err
+}
+
+// findOwnedSheet resolves the event and sheet of a request by the login
+// user on /api/events/:id/sheets/:rank/:num, for changing a reservation of
+// an event that has not started yet. When the request is refused, event is
+// nil and err is the result of the error response.
+func findOwnedSheet(c echo.Context) (*User, *Event, *Sheet, error) {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, nil, nil, resError(c, "not_found", 404)
+	}
+	rank := c.Param("rank")
+	num, err := strconv.ParseInt(c.Param("num"), 10, 64)
+	if err != nil {
+		return nil, nil, nil, resError(c, "invalid_sheet", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	event, err := getEvent(eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil, resError(c, "invalid_event", 404)
+		}
+		return nil, nil, nil, err
+	} else if !event.visible() {
+		return nil, nil, nil, resError(c, "invalid_event", 404)
+	}
+
+	if !validateRank(event, rank) {
+		return nil, nil, nil, resError(c, "invalid_rank", 404)
+	}
+
+	if err := event.checkCancelable(time.Now()); err != nil {
+		return nil, nil, nil, resError(c, "event_started", 403)
+	}
+
+	venue, _ := getVenue(event.VenueID)
+	sheet, ok := venue.Sheet(rank, num)
+	if !ok {
+		return nil, nil, nil, resError(c, "invalid_sheet", 404)
+	}
+	return user, event, sheet, nil
+}
+
+// lockOwnedReservation locks the live reservation of the sheet in tx. It
+// fails with errNotReserved or errNotOwner unless userID holds it.
+func lockOwnedReservation(tx *sql.Tx, event *Event, sheet *Sheet, userID int64) (*Reservation, error) {
+	var reservation Reservation
+	if err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL FOR UPDATE", event.ID, sheet.ID), &reservation); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errNotReserved
+		}
+		return nil, err
+	}
+	if reservation.UserID != userID {
+		return nil, errNotOwner
+	}
+	return &reservation, nil
+}
+
+// resOwnedReservationError responds to a failure of lockOwnedReservation.
+func resOwnedReservationError(c echo.Context, err error) error {
+	switch err {
+	case errNotReserved:
+		return resError(c, "not_reserved", 400)
+	case errNotOwner:
+		return resError(c, "not_permitted", 403)
+	}
+	return err
+}
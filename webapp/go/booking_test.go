@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// openTestDB connects to the database configured like the app through the
+// DB_* variables, with the schema and patch.sql applied, and loads the
+// venues. The test is skipped when no database is reachable.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if db != nil {
+		return
+	}
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
+		os.Getenv("DB_USER"), os.Getenv("DB_PASS"),
+		os.Getenv("DB_HOST"), os.Getenv("DB_PORT"),
+		os.Getenv("DB_DATABASE"),
+	)
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		t.Skip("database not available:", err)
+	}
+	conn.SetMaxOpenConns(32)
+	db = conn
+	if err := setVenues(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestEvent inserts an on sale event in the default venue, registers it
+// in the inventory and removes it with its reservations after the test.
+func addTestEvent(t *testing.T) *Event {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO events (title, public_fg, closed_fg, price, venue_id, state) VALUES (?, 1, 0, 1000, ?, ?)",
+		"concurrency test", defaultVenueID, StateOnSale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM reservations WHERE event_id = ?", eventID)
+		db.Exec("DELETE FROM events WHERE id = ?", eventID)
+	})
+
+	var event Event
+	if err := scanEvent(db.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", eventID), &event); err != nil {
+		t.Fatal(err)
+	}
+	venue, _ := getVenue(defaultVenueID)
+	inventory.AddEvent(eventID, venue)
+	return &event
+}
+
+func TestConcurrentReservationsAreUnique(t *testing.T) {
+	openTestDB(t)
+	event := addTestEvent(t)
+
+	venue, _ := getVenue(defaultVenueID)
+	rank, _ := venue.Rank("S")
+
+	const workers = 400
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var sheets []*Sheet
+			if i%2 == 0 {
+				taken, _, err := inventory.TakeN(event.ID, rank.Rank, 1+i%3, i%4 == 0)
+				if err != nil {
+					return
+				}
+				sheets = taken
+			} else {
+				sheet := rank.sheets[rand.Intn(len(rank.sheets))]
+				if err := inventory.Claim(event.ID, sheet); err != nil {
+					return
+				}
+				sheets = []*Sheet{sheet}
+			}
+			userID := int64(i%10 + 1)
+			if _, err := insertReservations(event, userID, sheets, ""); err != nil {
+				inventory.ReleaseAll(event.ID, sheets)
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			reserved += len(sheets)
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	var duplicated int
+	if err := db.QueryRow("SELECT COUNT(*) FROM (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL GROUP BY sheet_id HAVING COUNT(*) > 1) d", event.ID).Scan(&duplicated); err != nil {
+		t.Fatal(err)
+	}
+	if duplicated != 0 {
+		t.Errorf("%d sheets are reserved more than once", duplicated)
+	}
+
+	var live int
+	if err := db.QueryRow("SELECT COUNT(*) FROM reservations WHERE event_id = ? AND canceled_at IS NULL", event.ID).Scan(&live); err != nil {
+		t.Fatal(err)
+	}
+	remains, err := inventory.Remains(event.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live != reserved || live != rank.Total-remains[rank.Rank] {
+		t.Errorf("live reservations = %d, reserved = %d, taken in inventory = %d", live, reserved, rank.Total-remains[rank.Rank])
+	}
+}
+
+// TestActiveReservationUniqueKey checks that the database itself refuses a
+// second live reservation of a sheet, even past the inventory.
+func TestActiveReservationUniqueKey(t *testing.T) {
+	openTestDB(t)
+	event := addTestEvent(t)
+
+	venue, _ := getVenue(defaultVenueID)
+	sheet, _ := venue.Sheet("A", 1)
+	insert := func() (int64, error) {
+		tx, err := db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		id, err := insertReservation(tx, event, 1, sheet, Charge{Price: 1000}, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		return id, tx.Commit()
+	}
+
+	first, err := insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert(); err == nil {
+		t.Fatal("second live reservation of the sheet was accepted")
+	} else if myErr, ok := err.(*mysql.MySQLError); !ok || myErr.Number != 1062 {
+		t.Fatalf("second live reservation: got %v, want a duplicate key error", err)
+	}
+
+	if _, err := db.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insert(); err != nil {
+		t.Fatalf("reserving a canceled sheet again: %v", err)
+	}
+}
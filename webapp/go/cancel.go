@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cancelEvent moves the event to the canceled state and refunds every
+// active reservation of it in one transaction. The refunded reservations
+// are returned with their canceled_at set.
+func cancelEvent(eventID, administratorID int64) ([]Reservation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ? FOR UPDATE", eventID), &event); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := transitionEvent(tx, &event, StateCanceled, administratorID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	rows, err := tx.Query("SELECT "+reservationColumns+" FROM reservations WHERE event_id = ? AND canceled_at IS NULL ORDER BY reserved_at ASC, id ASC FOR UPDATE", event.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var refunded []Reservation
+	for rows.Next() {
+		var reservation Reservation
+		if err := scanReservation(rows, &reservation); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		refunded = append(refunded, reservation)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE event_id = ? AND canceled_at IS NULL", now.Format("2006-01-02 15:04:05.000000"), event.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM waitlists WHERE event_id = ? AND reservation_id IS NULL", event.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for i := range refunded {
+		refunded[i].CanceledAt = &now
+		sheet := getSheet(refunded[i].SheetID)
+		inventory.Release(event.ID, &sheet)
+	}
+	for _, h := range holds.RemoveEvent(event.ID) {
+		inventory.ReleaseAll(event.ID, h.Sheets)
+	}
+	return refunded, nil
+}
+
+// cancelAdminEventHandler cancels an event and responds with the refunds
+// as a sales report, in any of the report formats.
+func cancelAdminEventHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	format := negotiateReportFormat(c)
+	if format == nil {
+		return resError(c, "invalid_format", 400)
+	}
+
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+
+	refunded, err := cancelEvent(eventID, administrator.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		if err == errInvalidTransition {
+			return resError(c, "invalid_transition", 400)
+		}
+		return err
+	}
+
+	w, err := beginReport(c, format)
+	if err != nil {
+		return err
+	}
+	for i := range refunded {
+		report := newReport(&refunded[i], reportSale)
+		if err := w.Write(&report); err != nil {
+			return err
+		}
+	}
+	return w.End()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const maxEventsPerPage = 100
+
+var (
+	errInvalidEventQuery = errors.New("event: invalid query")
+	errInvalidCursor     = errors.New("invalid cursor")
+)
+
+// visibleStates are the states of events shown to users.
+var visibleStates = []string{StateOnSale, StatePaused, StateSoldOut}
+
+// eventSortKeys maps the sort parameter to the SQL expression ordered by.
+// Events without a start time sort last.
+var eventSortKeys = map[string]string{
+	"id":       "id",
+	"title":    "title",
+	"price":    "price",
+	"start_at": "COALESCE(start_at, '9999-12-31 23:59:59.999999')",
+}
+
+// EventQuery selects a page of events. Limit 0 returns every event.
+// Cursor continues after the last event of the previous page.
+type EventQuery struct {
+	States []string
+	Public *bool
+	Closed *bool
+	OnSale bool
+	Title  string
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor *pageCursor
+}
+
+// pageCursor is the sort key and id of the last row of a page.
+type pageCursor struct {
+	Key string `json:"k"`
+	ID  int64  `json:"id"`
+}
+
+func (cur *pageCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageCursor(s string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &cur, nil
+}
+
+// parseEventQuery reads the query parameters state, public, closed,
+// on_sale, q, sort, limit and cursor. Users only ever see visible events;
+// public and closed are only honored for administrators.
+func parseEventQuery(c echo.Context, admin bool) (*EventQuery, error) {
+	q := &EventQuery{Sort: "id"}
+
+	if v := c.QueryParam("state"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			if _, ok := eventTransitions[s]; !ok {
+				return nil, errInvalidEventQuery
+			}
+			q.States = append(q.States, s)
+		}
+	}
+	if !admin {
+		if q.States == nil {
+			q.States = visibleStates
+		}
+		for _, s := range q.States {
+			if !containsString(visibleStates, s) {
+				return nil, errInvalidEventQuery
+			}
+		}
+	}
+
+	if admin {
+		for _, p := range []struct {
+			name string
+			dst  **bool
+		}{{"public", &q.Public}, {"closed", &q.Closed}} {
+			if v := c.QueryParam(p.name); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, errInvalidEventQuery
+				}
+				*p.dst = &b
+			}
+		}
+	}
+	if v := c.QueryParam("on_sale"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errInvalidEventQuery
+		}
+		q.OnSale = b
+	}
+	q.Title = c.QueryParam("q")
+
+	if v := c.QueryParam("sort"); v != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(v, "-"), strings.HasPrefix(v, "-")
+		if _, ok := eventSortKeys[q.Sort]; !ok {
+			return nil, errInvalidEventQuery
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxEventsPerPage {
+			return nil, errInvalidEventQuery
+		}
+		q.Limit = limit
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		cur, err := decodePageCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		q.Cursor = cur
+	}
+	return q, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sql returns the query selecting the page of events, with its arguments.
+// One event more than the limit is selected to tell if there is a next page.
+func (q *EventQuery) sql() (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+
+	if len(q.States) > 0 {
+		conds = append(conds, "state IN (?"+strings.Repeat(", ?", len(q.States)-1)+")")
+		for _, s := range q.States {
+			args = append(args, s)
+		}
+	}
+	if q.Public != nil {
+		conds = append(conds, "public_fg = ?")
+		args = append(args, *q.Public)
+	}
+	if q.Closed != nil {
+		conds = append(conds, "closed_fg = ?")
+		args = append(args, *q.Closed)
+	}
+	if q.OnSale {
+		now := time.Now().UTC().Format("2006-01-02 15:04:05.000000")
+		conds = append(conds, "state = ? AND (sales_open_at IS NULL OR sales_open_at <= ?) AND (sales_close_at IS NULL OR sales_close_at > ?) AND (start_at IS NULL OR start_at > ?)")
+		args = append(args, StateOnSale, now, now, now)
+	}
+	if q.Title != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Title)
+		conds = append(conds, "title LIKE ?")
+		args = append(args, "%"+escaped+"%")
+	}
+
+	key := eventSortKeys[q.Sort]
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	if q.Cursor != nil {
+		if key == "id" {
+			conds = append(conds, "id "+op+" ?")
+			args = append(args, q.Cursor.ID)
+		} else {
+			conds = append(conds, "("+key+" "+op+" ? OR ("+key+" = ? AND id "+op+" ?))")
+			args = append(args, q.Cursor.Key, q.Cursor.Key, q.Cursor.ID)
+		}
+	}
+
+	query := "SELECT " + eventColumns + " FROM events WHERE " + strings.Join(conds, " AND ") + " ORDER BY "
+	if key != "id" {
+		query += key + " " + dir + ", "
+	}
+	query += "id " + dir
+	if q.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(q.Limit+1)
+	}
+	return query, args
+}
+
+// cursorAfter returns the cursor continuing after the event.
+func (q *EventQuery) cursorAfter(e *Event) string {
+	cur := pageCursor{ID: e.ID}
+	switch q.Sort {
+	case "title":
+		cur.Key = e.Title
+	case "price":
+		cur.Key = strconv.FormatInt(e.Price, 10)
+	case "start_at":
+		cur.Key = "9999-12-31 23:59:59.999999"
+		if e.StartAt != nil {
+			cur.Key = e.StartAt.UTC().Format("2006-01-02 15:04:05.000000")
+		}
+	}
+	return cur.encode()
+}
+
+func renderEvents(c echo.Context, admin bool) error {
+	q, err := parseEventQuery(c, admin)
+	if err != nil {
+		return resError(c, "invalid_query", 400)
+	}
+
+	events, next, err := findEvents(q)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		for i, v := range events {
+			events[i] = sanitizeEvent(v)
+		}
+	}
+	if next != "" {
+		c.Response().Header().Set("X-Next-Cursor", next)
+	}
+	return c.JSON(200, events)
+}
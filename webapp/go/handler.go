@@ -2,11 +2,11 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/labstack/echo/v4"
 )
@@ -27,7 +27,12 @@ func addUserHandler(c echo.Context) error {
 		return err
 	}
 
-	res, err := db.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, SHA2(?, 256), ?)", params.LoginName, params.Password, params.Nickname)
+	passHash, err := hashPassword(params.Password)
+	if err != nil {
+		return resError(c, "", 0)
+	}
+
+	res, err := db.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, ?, ?)", params.LoginName, passHash, params.Nickname)
 	if err != nil {
 		return resError(c, "", 0)
 	}
@@ -56,57 +61,18 @@ func getUserHandler(c echo.Context) error {
 		return resError(c, "forbidden", 403)
 	}
 
-	rows, err := db.Query(`
-	SELECT * FROM reservations r
-	JOIN events e
-	ON r.event_id = e.id
-	WHERE r.user_id = ? 
-	ORDER BY r.updated_at DESC
-	LIMIT 5`, user.ID)
+	recentReservations, _, err := findUserReservations(&ReservationQuery{UserID: user.ID, Limit: 5})
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
-
-	var recentReservations []Reservation
-	for rows.Next() {
-		var reservation Reservation
-		var event Event
-		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt,
-			&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.SRemains, &event.ARemains, &event.BRemains, &event.CRemains); err != nil {
-			return err
-		}
-		sheet := sheets[reservation.SheetID]
-
-		event.Sheets = nil
-		event.Total = 0
-		event.Remains = 0
-
-		e, err := makeEvent(event, reservation.UserID)
-		if err != nil {
-			return err
-		}
-
-		reservation.Event = e
-		reservation.SheetRank = sheet.Rank
-		reservation.SheetNum = sheet.Num
-		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-		if reservation.CanceledAt != nil {
-			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
-		}
-		recentReservations = append(recentReservations, reservation)
-	}
-	if recentReservations == nil {
-		recentReservations = make([]Reservation, 0)
-	}
 
 	var totalPrice int
 	if err := db.QueryRow("SELECT IFNULL(SUM(price), 0) FROM reservations WHERE user_id = ? AND canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
 		return err
 	}
 
-	rows, err = db.Query(`
-	SELECT e.*
+	rows, err := db.Query(`
+	SELECT `+qualify("e", eventColumns)+`
 	FROM reservations r
 	JOIN events e
 	ON e.id = r.event_id
@@ -119,7 +85,7 @@ func getUserHandler(c echo.Context) error {
 	var recentEvents []*Event
 	for rows.Next() {
 		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price, &event.SRemains, &event.ARemains, &event.BRemains, &event.CRemains); err != nil {
+		if err := scanEvent(rows, &event); err != nil {
 			return err
 		}
 		e, err := makeEvent(event, -1)
@@ -135,12 +101,18 @@ func getUserHandler(c echo.Context) error {
 		recentEvents = make([]*Event, 0)
 	}
 
+	waitlist, err := getUserWaitlist(user.ID)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(200, echo.Map{
 		"id":                  user.ID,
 		"nickname":            user.Nickname,
 		"recent_reservations": recentReservations,
 		"total_price":         totalPrice,
 		"recent_events":       recentEvents,
+		"waitlist":            waitlist,
 	})
 }
 
@@ -159,13 +131,13 @@ func loginHandler(c echo.Context) error {
 		return err
 	}
 
-	var passHash string
-	if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-		return err
-	}
-	if user.PassHash != passHash {
+	ok, rehash := verifyPassword(user.PassHash, params.Password)
+	if !ok {
 		return resError(c, "authentication_failed", 401)
 	}
+	if rehash {
+		upgradePasswordHash("users", user.ID, params.Password)
+	}
 
 	sessSetUserID(c, user.ID)
 	var err error
@@ -182,14 +154,7 @@ func logoutHandler(c echo.Context) error {
 }
 
 func getEventsHandler(c echo.Context) error {
-	events, err := getEvents(true)
-	if err != nil {
-		return err
-	}
-	for i, v := range events {
-		events[i] = sanitizeEvent(v)
-	}
-	return c.JSON(200, events)
+	return renderEvents(c, false)
 }
 
 func getEventHandler(c echo.Context) error {
@@ -209,7 +174,7 @@ func getEventHandler(c echo.Context) error {
 			return resError(c, "not_found", 404)
 		}
 		return err
-	} else if !event.PublicFg {
+	} else if !event.visible() {
 		return resError(c, "not_found", 404)
 	}
 	return c.JSON(200, sanitizeEvent(event))
@@ -221,7 +186,10 @@ func addReservationHandler(c echo.Context) error {
 		return resError(c, "not_found", 404)
 	}
 	var params struct {
-		Rank string `json:"sheet_rank"`
+		Rank      string `json:"sheet_rank"`
+		Quantity  int    `json:"quantity"`
+		Adjacent  bool   `json:"adjacent"`
+		PromoCode string `json:"promo_code"`
 	}
 	c.Bind(&params)
 
@@ -236,55 +204,63 @@ func addReservationHandler(c echo.Context) error {
 			return resError(c, "invalid_event", 404)
 		}
 		return err
-	} else if !event.PublicFg {
+	} else if !event.visible() {
 		return resError(c, "invalid_event", 404)
 	}
 
-	if !validateRank(params.Rank) {
+	if !validateRank(event, params.Rank) {
 		return resError(c, "invalid_rank", 400)
 	}
 
-	var sheet Sheet
-	var reservationID int64
-	for {
-		if err := db.QueryRow("SELECT * FROM sheets WHERE id NOT IN (SELECT sheet_id FROM reservations WHERE event_id = ? AND canceled_at IS NULL FOR UPDATE) AND `rank` = ? ORDER BY RAND() LIMIT 1", event.ID, params.Rank).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "sold_out", 409)
-			}
-			return err
-		}
+	if err := event.checkSelling(time.Now()); err != nil {
+		return resSalesWindowError(c, err)
+	}
 
-		res, err := db.Exec("INSERT INTO reservations (event_id, sheet_id, user_id, reserved_at, price) VALUES (?, ?, ?, ?, ?)",
-			event.ID, sheet.ID, user.ID, time.Now().UTC().Format("2006-01-02 15:04:05.000000"), sheet.Price+event.Price)
-		if err != nil {
-			log.Println("re-try: rollback by", err)
-			continue
-		}
-		reservationID, err = res.LastInsertId()
-		if err != nil {
-			log.Println("re-try: rollback by", err)
-			continue
-		}
+	if params.Quantity == 0 {
+		params.Quantity = 1
+	}
+	if params.Quantity < 0 || params.Quantity > maxSheetsPerReservation {
+		return resError(c, "invalid_quantity", 400)
+	}
 
-		eventsRemains[eventID]--
-		decrementRemains(strings.ToLower(sheet.Rank)+"_remains", int(eventID))
+	sheets, adjacent, err := inventory.TakeN(event.ID, params.Rank, params.Quantity, params.Adjacent)
+	if err != nil {
+		if err == errSoldOut {
+			return resError(c, "sold_out", 409)
+		}
+		return err
+	}
 
-		break
+	reserved, err := insertReservations(event, user.ID, sheets, params.PromoCode)
+	if err != nil {
+		inventory.ReleaseAll(event.ID, sheets)
+		return resBookingError(c, err)
 	}
+	updateSoldOut(event.ID)
+
 	return c.JSON(202, echo.Map{
-		"id":         reservationID,
-		"sheet_rank": params.Rank,
-		"sheet_num":  sheet.Num,
+		"id":           reserved[0].ID,
+		"sheet_rank":   params.Rank,
+		"sheet_num":    reserved[0].SheetNum,
+		"reservations": reserved,
+		"adjacent":     adjacent,
 	})
 }
 
-func removeReservationHandler(c echo.Context) error {
+func addSheetReservationHandler(c echo.Context) error {
 	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 	if err != nil {
 		return resError(c, "not_found", 404)
 	}
 	rank := c.Param("rank")
-	num := c.Param("num")
+	num, err := strconv.ParseInt(c.Param("num"), 10, 64)
+	if err != nil {
+		return resError(c, "invalid_sheet", 404)
+	}
+	var params struct {
+		PromoCode string `json:"promo_code"`
+	}
+	c.Bind(&params)
 
 	user, err := getLoginUser(c)
 	if err != nil {
@@ -297,38 +273,60 @@ func removeReservationHandler(c echo.Context) error {
 			return resError(c, "invalid_event", 404)
 		}
 		return err
-	} else if !event.PublicFg {
+	} else if !event.visible() {
 		return resError(c, "invalid_event", 404)
 	}
 
-	if !validateRank(rank) {
+	if !validateRank(event, rank) {
 		return resError(c, "invalid_rank", 404)
 	}
 
-	var sheet Sheet
-	if err := db.QueryRow("SELECT * FROM sheets WHERE `rank` = ? AND num = ?", rank, num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-		if err == sql.ErrNoRows {
-			return resError(c, "invalid_sheet", 404)
+	if err := event.checkSelling(time.Now()); err != nil {
+		return resSalesWindowError(c, err)
+	}
+
+	venue, _ := getVenue(event.VenueID)
+	sheet, ok := venue.Sheet(rank, num)
+	if !ok {
+		return resError(c, "invalid_sheet", 404)
+	}
+
+	if err := inventory.Claim(event.ID, sheet); err != nil {
+		if err == errSheetTaken {
+			return resError(c, "already_reserved", 409)
 		}
 		return err
 	}
 
-	tx, err := db.Begin()
+	reserved, err := insertReservations(event, user.ID, []*Sheet{sheet}, params.PromoCode)
 	if err != nil {
+		inventory.Release(event.ID, sheet)
+		return resBookingError(c, err)
+	}
+	updateSoldOut(event.ID)
+
+	return c.JSON(202, echo.Map{
+		"id":         reserved[0].ID,
+		"sheet_rank": sheet.Rank,
+		"sheet_num":  sheet.Num,
+	})
+}
+
+func removeReservationHandler(c echo.Context) error {
+	user, event, sheet, err := findOwnedSheet(c)
+	if event == nil {
 		return err
 	}
 
-	var reservation Reservation
-	if err := tx.QueryRow("SELECT * FROM reservations WHERE event_id = ? AND sheet_id = ? AND canceled_at IS NULL GROUP BY event_id HAVING reserved_at = MIN(reserved_at) FOR UPDATE", event.ID, sheet.ID).Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt); err != nil {
-		tx.Rollback()
-		if err == sql.ErrNoRows {
-			return resError(c, "not_reserved", 400)
-		}
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
-	if reservation.UserID != user.ID {
+
+	reservation, err := lockOwnedReservation(tx, event, sheet, user.ID)
+	if err != nil {
 		tx.Rollback()
-		return resError(c, "not_permitted", 403)
+		return resOwnedReservationError(c, err)
 	}
 
 	if _, err := tx.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", time.Now().UTC().Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
@@ -336,13 +334,21 @@ func removeReservationHandler(c echo.Context) error {
 		return err
 	}
 
+	promoted, err := promoteWaitlist(tx, event, sheet)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	eventsRemains[eventID]++
-	incrementRemains(strings.ToLower(sheet.Rank)+"_remains", int(eventID))
+	if !promoted {
+		inventory.Release(event.ID, sheet)
+		updateSoldOut(event.ID)
+	}
 
 	return c.NoContent(204)
 }
@@ -378,13 +384,13 @@ func loginAdminHandler(c echo.Context) error {
 		return err
 	}
 
-	var passHash string
-	if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
-		return err
-	}
-	if administrator.PassHash != passHash {
+	ok, rehash := verifyPassword(administrator.PassHash, params.Password)
+	if !ok {
 		return resError(c, "authentication_failed", 401)
 	}
+	if rehash {
+		upgradePasswordHash("administrators", administrator.ID, params.Password)
+	}
 
 	sessSetAdministratorID(c, administrator.ID)
 	var err error
@@ -401,37 +407,83 @@ func logoutAdminHandler(c echo.Context) error {
 }
 
 func getAdminEventsHandler(c echo.Context) error {
-	events, err := getEvents(true)
-	if err != nil {
-		return err
-	}
-	return c.JSON(200, events)
+	return renderEvents(c, true)
 }
 
 func addAdminEventHandler(c echo.Context) error {
 	var params struct {
-		Title  string `json:"title"`
-		Public bool   `json:"public"`
-		Price  int    `json:"price"`
+		Title        string `json:"title"`
+		Public       bool   `json:"public"`
+		Price        int    `json:"price"`
+		VenueID      int64  `json:"venue_id"`
+		StartAt      int64  `json:"start_at"`
+		SalesOpenAt  int64  `json:"sales_open_at"`
+		SalesCloseAt int64  `json:"sales_close_at"`
+
+		MaxPerUser int64            `json:"max_per_user"`
+		RankLimits map[string]int64 `json:"rank_limits"`
 	}
 	c.Bind(&params)
+	if params.VenueID == 0 {
+		params.VenueID = defaultVenueID
+	}
 
-	res, err := db.Exec("INSERT INTO events (title, public_fg, closed_fg, price, s_remains, a_remains, b_remains, c_remains) VALUES (?, ?, 0, ?, 50, 150, 300, 500)", params.Title, params.Public, params.Price)
+	venue, ok := getVenue(params.VenueID)
+	if !ok {
+		return resError(c, "invalid_venue", 400)
+	}
+
+	startAt, salesOpenAt, salesCloseAt := timeFromUnix(params.StartAt), timeFromUnix(params.SalesOpenAt), timeFromUnix(params.SalesCloseAt)
+	if !validSchedule(startAt, salesOpenAt, salesCloseAt) {
+		return resError(c, "invalid_schedule", 400)
+	}
+	if !validLimits(venue, params.MaxPerUser, params.RankLimits) {
+		return resError(c, "invalid_limit", 400)
+	}
+
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+
+	res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price, venue_id, start_at, sales_open_at, sales_close_at, state, max_per_user) VALUES (?, 0, 0, ?, ?, ?, ?, ?, ?, ?)",
+		params.Title, params.Price, venue.ID, nullTime(startAt), nullTime(salesOpenAt), nullTime(salesCloseAt), StateDraft, params.MaxPerUser)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	eventID, err := res.LastInsertId()
 	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveRankLimits(tx, eventID, params.RankLimits); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if params.Public {
+		if err := transitionEvent(tx, &Event{ID: eventID, State: StateDraft}, StateOnSale, administrator.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
 		return err
 	}
 
+	inventory.AddEvent(eventID, venue)
+
 	event, err := getEvent(eventID, -1)
 	if err != nil {
 		return err
 	}
 
-	eventsRemains[eventID] = TotalSheets
-
 	return c.JSON(200, event)
 }
 
@@ -456,30 +508,184 @@ func editAdminEventHandler(c echo.Context) error {
 		return resError(c, "not_found", 404)
 	}
 
+	// Fields left out of the request keep their current value. public and
+	// closed are the flags of the admin page, mapped onto state transitions.
 	var params struct {
-		Public bool `json:"public"`
-		Closed bool `json:"closed"`
+		Public       *bool   `json:"public"`
+		Closed       *bool   `json:"closed"`
+		Title        *string `json:"title"`
+		Price        *int64  `json:"price"`
+		VenueID      *int64  `json:"venue_id"`
+		StartAt      *int64  `json:"start_at"`
+		SalesOpenAt  *int64  `json:"sales_open_at"`
+		SalesCloseAt *int64  `json:"sales_close_at"`
+
+		MaxPerUser *int64 `json:"max_per_user"`
+		// RankLimits updates only the ranks it names; 0 removes a limit.
+		RankLimits map[string]int64 `json:"rank_limits"`
 	}
 	c.Bind(&params)
-	if params.Closed {
-		params.Public = false
+
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
 	}
 
-	event, err := getEvent(eventID, -1)
+	tx, err := db.Begin()
 	if err != nil {
+		return err
+	}
+
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ? FOR UPDATE", eventID), &event); err != nil {
+		tx.Rollback()
 		if err == sql.ErrNoRows {
 			return resError(c, "not_found", 404)
 		}
 		return err
 	}
+	if event.RankLimits, err = loadRankLimits(tx, event.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	state := event.State
+	if params.Closed != nil && *params.Closed {
+		state = StateClosed
+	} else if params.Public != nil && *params.Public {
+		if state == StateDraft || state == StatePaused {
+			state = StateOnSale
+		}
+	} else if params.Public != nil {
+		state = StateDraft
+	}
+
+	edited := event
+	if params.Title != nil {
+		edited.Title = strings.TrimSpace(*params.Title)
+	}
+	if params.Price != nil {
+		edited.Price = *params.Price
+	}
+	if params.VenueID != nil {
+		edited.VenueID = *params.VenueID
+	}
+	if params.StartAt != nil {
+		edited.StartAt = timeFromUnix(*params.StartAt)
+	}
+	if params.SalesOpenAt != nil {
+		edited.SalesOpenAt = timeFromUnix(*params.SalesOpenAt)
+	}
+	if params.SalesCloseAt != nil {
+		edited.SalesCloseAt = timeFromUnix(*params.SalesCloseAt)
+	}
+	if params.MaxPerUser != nil {
+		edited.MaxPerUser = *params.MaxPerUser
+	}
+	edited.RankLimits = make(map[string]int64, len(event.RankLimits))
+	for rank, limit := range event.RankLimits {
+		edited.RankLimits[rank] = limit
+	}
+	for rank, limit := range params.RankLimits {
+		if limit == 0 {
+			delete(edited.RankLimits, rank)
+		} else {
+			edited.RankLimits[rank] = limit
+		}
+	}
+
+	var errCode string
+	if event.final() {
+		errCode = "cannot_edit_closed_event"
+	} else if event.PublicFg && state == StateClosed {
+		errCode = "cannot_close_public_event"
+	} else if state != event.State && !canTransition(event.State, state) {
+		errCode = "invalid_transition"
+	} else if edited.Title == "" || utf8.RuneCountInString(edited.Title) > 128 {
+		errCode = "invalid_title"
+	} else if edited.Price < 0 {
+		errCode = "invalid_price"
+	} else if !validSchedule(edited.StartAt, edited.SalesOpenAt, edited.SalesCloseAt) {
+		errCode = "invalid_schedule"
+	}
+	if errCode != "" {
+		tx.Rollback()
+		return resError(c, errCode, 400)
+	}
+
+	venue, ok := getVenue(edited.VenueID)
+	if !ok {
+		tx.Rollback()
+		return resError(c, "invalid_venue", 400)
+	}
+	if !validLimits(venue, edited.MaxPerUser, edited.RankLimits) {
+		tx.Rollback()
+		return resError(c, "invalid_limit", 400)
+	}
+
+	audits := diffEvents(&event, &edited)
+	if len(audits) == 0 && state == event.State {
+		tx.Rollback()
+		e, err := getEvent(eventID, -1)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, e)
+	}
 
-	if event.ClosedFg {
-		return resError(c, "cannot_edit_closed_event", 400)
-	} else if event.PublicFg && params.Closed {
-		return resError(c, "cannot_close_public_event", 400)
+	// Sold reservations keep the price they were sold at; only new sales
+	// use the edited price. The layout can only change while nothing is sold.
+	relayout := edited.VenueID != event.VenueID
+	if relayout {
+		var active int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM reservations WHERE event_id = ? AND canceled_at IS NULL", event.ID).Scan(&active); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if active > 0 {
+			tx.Rollback()
+			return resError(c, "event_has_reservations", 409)
+		}
 	}
 
-	if _, err := db.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", params.Public, params.Closed, event.ID); err != nil {
+	if _, err := tx.Exec("UPDATE events SET title = ?, price = ?, venue_id = ?, start_at = ?, sales_open_at = ?, sales_close_at = ?, max_per_user = ? WHERE id = ?",
+		edited.Title, edited.Price, edited.VenueID,
+		nullTime(edited.StartAt), nullTime(edited.SalesOpenAt), nullTime(edited.SalesCloseAt), edited.MaxPerUser, event.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := saveRankLimits(tx, event.ID, edited.RankLimits); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertEventAudits(tx, administrator.ID, audits); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if state != event.State {
+		if err := transitionEvent(tx, &event, state, administrator.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if relayout {
+		if err := inventory.Relayout(event.ID, venue); err != nil {
+			tx.Rollback()
+			if err == errEventInUse {
+				return resError(c, "event_has_reservations", 409)
+			}
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		if relayout {
+			oldVenue, _ := getVenue(event.VenueID)
+			if err := inventory.Relayout(event.ID, oldVenue); err != nil {
+				log.Println("restore event layout:", err)
+			}
+		}
 		return err
 	}
 
@@ -487,8 +693,7 @@ func editAdminEventHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	c.JSON(200, e)
-	return nil
+	return c.JSON(200, e)
 }
 
 func getReportHandler(c echo.Context) error {
@@ -497,71 +702,40 @@ func getReportHandler(c echo.Context) error {
 		return resError(c, "not_found", 404)
 	}
 
-	rows, err := db.Query("SELECT * FROM reservations WHERE event_id = ? ORDER BY reserved_at ASC", eventID)
+	format := negotiateReportFormat(c)
+	if format == nil {
+		return resError(c, "invalid_format", 400)
+	}
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		return resError(c, "invalid_filter", 400)
+	}
+	filter.EventID = eventID
+
+	rows, err := queryReports(filter)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
-	var reports []Report
-	for rows.Next() {
-		var reservation Reservation
-		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt); err != nil {
-			return err
-		}
-		sheet := sheets[reservation.SheetID]
-		report := Report{
-			ReservationID: reservation.ID,
-			EventID:       eventID,
-			Rank:          sheet.Rank,
-			Num:           sheet.Num,
-			UserID:        reservation.UserID,
-			SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-			Price:         reservation.Price,
-		}
-		if reservation.CanceledAt != nil {
-			report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
-		}
-		reports = append(reports, report)
-	}
-	return renderReportCSV(c, reports)
+	return renderReport(c, format, rows)
 }
 
 func getReportsHandler(c echo.Context) error {
-	rows, err := db.Query(`SELECT * FROM reservations ORDER BY reserved_at asc`)
+	format := negotiateReportFormat(c)
+	if format == nil {
+		return resError(c, "invalid_format", 400)
+	}
+	filter, err := parseReportFilter(c)
 	if err != nil {
-		return err
+		return resError(c, "invalid_filter", 400)
 	}
-	defer rows.Close()
 
-	var reports []Report
-	for rows.Next() {
-		var reservation Reservation
-		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.Price, &reservation.UpdatedAt); err != nil {
-			return err
-		}
-		sheet := sheets[reservation.SheetID]
-		report := Report{
-			ReservationID: reservation.ID,
-			EventID:       reservation.EventID,
-			Rank:          sheet.Rank,
-			Num:           sheet.Num,
-			UserID:        reservation.UserID,
-			SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-			Price:         reservation.Price,
-		}
-		if reservation.CanceledAt != nil {
-			report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
-		}
-		reports = append(reports, report)
+	rows, err := queryReports(filter)
+	if err != nil {
+		return err
 	}
-	return renderReportCSV(c, reports)
-}
-
-func decrementRemains(row string, id int) {
-	db.Exec(fmt.Sprintf(`UPDATE events SET %s = %s - 1 WHERE id = ?`, row, row), id)
-}
+	defer rows.Close()
 
-func incrementRemains(row string, id int) {
-	db.Exec(fmt.Sprintf(`UPDATE events SET %s = %s + 1 WHERE id = ?`, row, row), id)
+	return renderReport(c, format, rows)
 }
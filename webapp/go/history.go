@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultReservationsPerPage = 20
+	maxReservationsPerPage     = 100
+)
+
+// ReservationQuery selects a page of a user's reservations, most recently
+// reserved or canceled first.
+type ReservationQuery struct {
+	UserID  int64
+	EventID int64
+	Status  string // "", "active" or "canceled"
+	Limit   int
+	Cursor  *pageCursor
+}
+
+// findUserReservations returns the page of reservations selected by q with
+// their events, and the cursor of the next page if there is one. Without a
+// status, reservations the user transferred or resold to someone else are
+// included and marked as transferred.
+func findUserReservations(q *ReservationQuery) ([]Reservation, string, error) {
+	var conds []string
+	var args []interface{}
+	switch q.Status {
+	case "active":
+		conds = append(conds, "r.user_id = ?", "r.canceled_at IS NULL")
+		args = append(args, q.UserID)
+	case "canceled":
+		conds = append(conds, "r.user_id = ?", "r.canceled_at IS NOT NULL")
+		args = append(args, q.UserID)
+	default:
+		conds = append(conds, "(r.user_id = ? OR r.id IN (SELECT reservation_id FROM reservation_transfers WHERE from_user_id = ? AND accepted_at IS NOT NULL) "+
+			"OR r.id IN (SELECT reservation_id FROM resale_listings WHERE seller_id = ? AND sold_at IS NOT NULL))")
+		args = append(args, q.UserID, q.UserID, q.UserID)
+	}
+	if q.EventID != 0 {
+		conds = append(conds, "r.event_id = ?")
+		args = append(args, q.EventID)
+	}
+	if q.Cursor != nil {
+		conds = append(conds, "(r.updated_at < ? OR (r.updated_at = ? AND r.id < ?))")
+		args = append(args, q.Cursor.Key, q.Cursor.Key, q.Cursor.ID)
+	}
+
+	rows, err := db.Query(`
+	SELECT `+qualify("r", reservationColumns)+`, `+qualify("e", eventColumns)+`
+	FROM reservations r
+	JOIN events e
+	ON r.event_id = e.id
+	WHERE `+strings.Join(conds, " AND ")+`
+	ORDER BY r.updated_at DESC, r.id DESC
+	LIMIT `+strconv.Itoa(q.Limit+1), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	events := map[int64]*Event{}
+	reservations := make([]Reservation, 0)
+	for rows.Next() {
+		var reservation Reservation
+		var event Event
+		if err := rows.Scan(append(reservation.columns(), event.columns()...)...); err != nil {
+			return nil, "", err
+		}
+		sheet := getSheet(reservation.SheetID)
+
+		e, ok := events[event.ID]
+		if !ok {
+			if e, err = makeEvent(event, q.UserID); err != nil {
+				return nil, "", err
+			}
+			events[event.ID] = e
+		}
+
+		reservation.Event = e
+		reservation.SheetRank = sheet.Rank
+		reservation.SheetNum = sheet.Num
+		reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
+		reservation.Transferred = reservation.UserID != q.UserID
+		if !reservation.Transferred && reservation.CanceledAt == nil {
+			reservation.Ticket = (&Ticket{ReservationID: reservation.ID, EventID: reservation.EventID, UserID: reservation.UserID}).Token()
+		}
+		if reservation.CanceledAt != nil {
+			reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
+		}
+		reservations = append(reservations, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(reservations) > q.Limit {
+		reservations = reservations[:q.Limit]
+		last := reservations[len(reservations)-1]
+		next = (&pageCursor{Key: last.UpdatedAt.UTC().Format("2006-01-02 15:04:05.000000"), ID: last.ID}).encode()
+	}
+	return reservations, next, nil
+}
+
+func getUserReservationsHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	loginUser, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+	if userID != loginUser.ID {
+		return resError(c, "forbidden", 403)
+	}
+
+	q := &ReservationQuery{UserID: userID, Limit: defaultReservationsPerPage}
+	if v := c.QueryParam("event_id"); v != "" {
+		if q.EventID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return resError(c, "invalid_query", 400)
+		}
+	}
+	switch q.Status = c.QueryParam("status"); q.Status {
+	case "", "active", "canceled":
+	default:
+		return resError(c, "invalid_query", 400)
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 || q.Limit > maxReservationsPerPage {
+			return resError(c, "invalid_query", 400)
+		}
+	}
+	if v := c.QueryParam("cursor"); v != "" {
+		if q.Cursor, err = decodePageCursor(v); err != nil {
+			return resError(c, "invalid_query", 400)
+		}
+	}
+
+	reservations, next, err := findUserReservations(q)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		c.Response().Header().Set("X-Next-Cursor", next)
+	}
+	return c.JSON(200, reservations)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errHoldNotFound = errors.New("hold: not found")
+	errHoldExpired  = errors.New("hold: expired")
+)
+
+// Hold keeps sheets of an event taken in the inventory for a user until it
+// is confirmed into reservations, canceled, or expires.
+type Hold struct {
+	ID        int64     `json:"id"`
+	EventID   int64     `json:"event_id"`
+	UserID    int64     `json:"-"`
+	Rank      string    `json:"sheet_rank"`
+	Sheets    []*Sheet  `json:"-"`
+	ExpiresAt time.Time `json:"-"`
+
+	SheetNums     []int64 `json:"sheet_nums"`
+	ExpiresAtUnix int64   `json:"expires_at"`
+}
+
+type HoldStore struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	nextID int64
+	holds  map[int64]*Hold
+}
+
+func NewHoldStore(ttl time.Duration) *HoldStore {
+	return &HoldStore{ttl: ttl, holds: map[int64]*Hold{}}
+}
+
+var holds *HoldStore
+
+// Add registers a hold on sheets already taken from the inventory.
+func (s *HoldStore) Add(eventID, userID int64, rank string, sheets []*Sheet) *Hold {
+	h := &Hold{
+		EventID:   eventID,
+		UserID:    userID,
+		Rank:      rank,
+		Sheets:    sheets,
+		ExpiresAt: time.Now().Add(s.ttl),
+	}
+	for _, sheet := range sheets {
+		h.SheetNums = append(h.SheetNums, sheet.Num)
+	}
+	h.ExpiresAtUnix = h.ExpiresAt.Unix()
+
+	s.mu.Lock()
+	s.nextID++
+	h.ID = s.nextID
+	s.holds[h.ID] = h
+	s.mu.Unlock()
+	return h
+}
+
+// Remove takes the hold of the user out of the store. An expired hold is
+// removed and its sheets are released, but errHoldExpired is returned.
+func (s *HoldStore) Remove(holdID, userID int64) (*Hold, error) {
+	s.mu.Lock()
+	h, ok := s.holds[holdID]
+	if !ok || h.UserID != userID {
+		s.mu.Unlock()
+		return nil, errHoldNotFound
+	}
+	delete(s.holds, holdID)
+	s.mu.Unlock()
+
+	if time.Now().After(h.ExpiresAt) {
+		releaseSheets(h.EventID, h.Sheets)
+		return nil, errHoldExpired
+	}
+	return h, nil
+}
+
+// Restore puts back a hold taken out by Remove, keeping its ID and expiry,
+// when it could not be confirmed for a reason the user can fix.
+func (s *HoldStore) Restore(h *Hold) {
+	s.mu.Lock()
+	s.holds[h.ID] = h
+	s.mu.Unlock()
+}
+
+// Reset drops every hold without releasing its sheets, for use when the
+// inventory itself is rebuilt.
+func (s *HoldStore) Reset() {
+	s.mu.Lock()
+	s.holds = map[int64]*Hold{}
+	s.mu.Unlock()
+}
+
+// RemoveEvent takes every hold on the event out of the store without
+// releasing its sheets.
+func (s *HoldStore) RemoveEvent(eventID int64) []*Hold {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed []*Hold
+	for id, h := range s.holds {
+		if h.EventID == eventID {
+			removed = append(removed, h)
+			delete(s.holds, id)
+		}
+	}
+	return removed
+}
+
+// Held returns the sheets of the event the user holds.
+func (s *HoldStore) Held(eventID, userID int64) []*Sheet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var held []*Sheet
+	for _, h := range s.holds {
+		if h.EventID == eventID && h.UserID == userID {
+			held = append(held, h.Sheets...)
+		}
+	}
+	return held
+}
+
+func (s *HoldStore) expire(now time.Time) []*Hold {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*Hold
+	for id, h := range s.holds {
+		if now.After(h.ExpiresAt) {
+			expired = append(expired, h)
+			delete(s.holds, id)
+		}
+	}
+	return expired
+}
+
+// Sweep releases the sheets of expired holds every interval. It never
+// returns and is meant to run in its own goroutine.
+func (s *HoldStore) Sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, h := range s.expire(now) {
+			releaseSheets(h.EventID, h.Sheets)
+		}
+	}
+}
+
+func addHoldHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank      string  `json:"sheet_rank"`
+		Quantity  int     `json:"quantity"`
+		Adjacent  bool    `json:"adjacent"`
+		SheetNums []int64 `json:"sheet_nums"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	event, err := getEvent(eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.visible() {
+		return resError(c, "invalid_event", 404)
+	}
+
+	if !validateRank(event, params.Rank) {
+		return resError(c, "invalid_rank", 400)
+	}
+
+	if err := event.checkSelling(time.Now()); err != nil {
+		return resSalesWindowError(c, err)
+	}
+
+	var sheets []*Sheet
+	if len(params.SheetNums) > 0 {
+		if len(params.SheetNums) > maxSheetsPerReservation {
+			return resError(c, "invalid_quantity", 400)
+		}
+		venue, _ := getVenue(event.VenueID)
+		for _, num := range params.SheetNums {
+			sheet, ok := venue.Sheet(params.Rank, num)
+			if !ok {
+				inventory.ReleaseAll(event.ID, sheets)
+				return resError(c, "invalid_sheet", 404)
+			}
+			if err := inventory.Claim(event.ID, sheet); err != nil {
+				inventory.ReleaseAll(event.ID, sheets)
+				if err == errSheetTaken {
+					return resError(c, "already_reserved", 409)
+				}
+				return err
+			}
+			sheets = append(sheets, sheet)
+		}
+	} else {
+		if params.Quantity == 0 {
+			params.Quantity = 1
+		}
+		if params.Quantity < 0 || params.Quantity > maxSheetsPerReservation {
+			return resError(c, "invalid_quantity", 400)
+		}
+		sheets, _, err = inventory.TakeN(event.ID, params.Rank, params.Quantity, params.Adjacent)
+		if err != nil {
+			if err == errSoldOut {
+				return resError(c, "sold_out", 409)
+			}
+			return err
+		}
+	}
+
+	// The hold is added before the commit releases the user row, so that
+	// concurrent holds of the user count it against the limits.
+	tx, err := db.Begin()
+	if err != nil {
+		inventory.ReleaseAll(event.ID, sheets)
+		return err
+	}
+	if err := checkPurchaseLimits(tx, event, user.ID, sheets); err != nil {
+		tx.Rollback()
+		inventory.ReleaseAll(event.ID, sheets)
+		if err == errLimitExceeded {
+			return resError(c, "limit_exceeded", 409)
+		}
+		return err
+	}
+	hold := holds.Add(event.ID, user.ID, params.Rank, sheets)
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		if _, err := holds.Remove(hold.ID, user.ID); err == nil {
+			inventory.ReleaseAll(event.ID, sheets)
+		}
+		return err
+	}
+	updateSoldOut(event.ID)
+	return c.JSON(201, hold)
+}
+
+func confirmHoldHandler(c echo.Context) error {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "hold_not_found", 404)
+	}
+
+	var params struct {
+		PromoCode string `json:"promo_code"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	hold, err := holds.Remove(holdID, user.ID)
+	if err != nil {
+		if err == errHoldExpired {
+			return resError(c, "hold_expired", 410)
+		}
+		return resError(c, "hold_not_found", 404)
+	}
+
+	event, err := getEvent(hold.EventID, user.ID)
+	if err != nil {
+		releaseSheets(hold.EventID, hold.Sheets)
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.visible() {
+		releaseSheets(hold.EventID, hold.Sheets)
+		return resError(c, "invalid_event", 404)
+	}
+	if err := event.checkSelling(time.Now()); err != nil {
+		releaseSheets(hold.EventID, hold.Sheets)
+		return resSalesWindowError(c, err)
+	}
+
+	reserved, err := insertReservations(event, user.ID, hold.Sheets, params.PromoCode)
+	if err != nil {
+		switch err {
+		case errPromoInvalid, errPromoExhausted, errLimitExceeded:
+			// The user may retry with another code or after canceling
+			// other reservations, so the sheets stay held.
+			holds.Restore(hold)
+		default:
+			releaseSheets(event.ID, hold.Sheets)
+		}
+		return resBookingError(c, err)
+	}
+	updateSoldOut(event.ID)
+
+	return c.JSON(202, echo.Map{
+		"id":           reserved[0].ID,
+		"sheet_rank":   hold.Rank,
+		"sheet_num":    reserved[0].SheetNum,
+		"reservations": reserved,
+	})
+}
+
+func removeHoldHandler(c echo.Context) error {
+	holdID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "hold_not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	hold, err := holds.Remove(holdID, user.ID)
+	if err != nil {
+		if err == errHoldExpired {
+			return c.NoContent(204)
+		}
+		return resError(c, "hold_not_found", 404)
+	}
+	releaseSheets(hold.EventID, hold.Sheets)
+
+	return c.NoContent(204)
+}
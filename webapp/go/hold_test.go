@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHoldStoreHeld(t *testing.T) {
+	s := NewHoldStore(time.Minute)
+	venue := newTestVenue(1, 5, "S", "A")
+	sheet := func(rank string, num int64) *Sheet {
+		sheet, _ := venue.Sheet(rank, num)
+		return sheet
+	}
+
+	s.Add(1, 10, "S", []*Sheet{sheet("S", 1), sheet("S", 2)})
+	h := s.Add(1, 10, "A", []*Sheet{sheet("A", 1)})
+	s.Add(1, 11, "S", []*Sheet{sheet("S", 3)})
+	s.Add(2, 10, "S", []*Sheet{sheet("S", 4)})
+
+	if held := s.Held(1, 10); len(held) != 3 {
+		t.Fatalf("Held(1, 10) = %d sheets, want 3", len(held))
+	}
+	if _, err := s.Remove(h.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+	if held := s.Held(1, 10); len(held) != 2 {
+		t.Fatalf("Held(1, 10) after Remove = %d sheets, want 2", len(held))
+	}
+	if held := s.Held(1, 12); len(held) != 0 {
+		t.Fatalf("Held of a user without holds = %d sheets", len(held))
+	}
+}
+
+func TestHoldStoreRestore(t *testing.T) {
+	s := NewHoldStore(time.Minute)
+	venue := newTestVenue(1, 5, "S")
+	sheet, _ := venue.Sheet("S", 1)
+
+	h := s.Add(1, 10, "S", []*Sheet{sheet})
+	removed, err := s.Remove(h.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := s.Held(1, 10); len(held) != 0 {
+		t.Fatalf("Held after Remove = %d sheets, want 0", len(held))
+	}
+
+	s.Restore(removed)
+	if held := s.Held(1, 10); len(held) != 1 {
+		t.Fatalf("Held after Restore = %d sheets, want 1", len(held))
+	}
+	again, err := s.Remove(h.ID, 10)
+	if err != nil {
+		t.Fatalf("Remove of a restored hold: %v", err)
+	}
+	if !again.ExpiresAt.Equal(h.ExpiresAt) {
+		t.Fatalf("restored hold expires at %v, want %v", again.ExpiresAt, h.ExpiresAt)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sync"
+)
+
+var (
+	errUnknownEvent = errors.New("inventory: unknown event")
+	errInvalidRank  = errors.New("inventory: invalid rank")
+	errSoldOut      = errors.New("inventory: sold out")
+	errSheetTaken   = errors.New("inventory: sheet already taken")
+	errEventInUse   = errors.New("inventory: event has taken sheets")
+)
+
+// bitset holds one bit per sheet of a rank; a set bit means the sheet is free.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)       { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int)     { b[i/64] &^= 1 << uint(i%64) }
+func (b bitset) test(i int) bool { return b[i/64]&(1<<uint(i%64)) != 0 }
+
+// next returns the index of the first set bit at or after i, or -1.
+func (b bitset) next(i int) int {
+	w := i / 64
+	if w >= len(b) {
+		return -1
+	}
+	if word := b[w] >> uint(i%64); word != 0 {
+		return i + bits.TrailingZeros64(word)
+	}
+	for w++; w < len(b); w++ {
+		if b[w] != 0 {
+			return w*64 + bits.TrailingZeros64(b[w])
+		}
+	}
+	return -1
+}
+
+type rankInventory struct {
+	sheets  []*Sheet
+	index   map[int64]int
+	free    bitset
+	remains int
+}
+
+func newRankInventory(sheets []*Sheet) *rankInventory {
+	r := &rankInventory{
+		sheets:  sheets,
+		index:   make(map[int64]int, len(sheets)),
+		free:    newBitset(len(sheets)),
+		remains: len(sheets),
+	}
+	for i, s := range sheets {
+		r.index[s.ID] = i
+		r.free.set(i)
+	}
+	return r
+}
+
+type eventInventory struct {
+	mu    sync.Mutex
+	ranks map[string]*rankInventory
+}
+
+// Inventory tracks which sheets of every event are still free. It is the
+// single source of truth for remaining seats: allocations and releases go
+// through it before touching the reservations table, and it is rebuilt from
+// that table on startup and on /initialize.
+type Inventory struct {
+	mu     sync.RWMutex
+	events map[int64]*eventInventory
+}
+
+func NewInventory() *Inventory {
+	return &Inventory{events: map[int64]*eventInventory{}}
+}
+
+var inventory = NewInventory()
+
+// Load rebuilds the inventory from the events and the live reservations.
+func (inv *Inventory) Load() error {
+	events := map[int64]*eventInventory{}
+
+	rows, err := db.Query("SELECT id, venue_id FROM events")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var eventID, venueID int64
+		if err := rows.Scan(&eventID, &venueID); err != nil {
+			rows.Close()
+			return err
+		}
+		venue, ok := getVenue(venueID)
+		if !ok {
+			rows.Close()
+			return fmt.Errorf("event %d: unknown venue %d", eventID, venueID)
+		}
+		events[eventID] = newEventInventory(venue)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT event_id, sheet_id FROM reservations WHERE canceled_at IS NULL")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventID, sheetID int64
+		if err := rows.Scan(&eventID, &sheetID); err != nil {
+			return err
+		}
+		if e, ok := events[eventID]; ok {
+			e.take(getSheet(sheetID).Rank, sheetID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	inv.mu.Lock()
+	inv.events = events
+	inv.mu.Unlock()
+	return nil
+}
+
+func newEventInventory(venue *Venue) *eventInventory {
+	e := &eventInventory{ranks: make(map[string]*rankInventory, len(venue.Ranks))}
+	for _, r := range venue.Ranks {
+		e.ranks[r.Rank] = newRankInventory(r.sheets)
+	}
+	return e
+}
+
+func (e *eventInventory) take(rank string, sheetID int64) bool {
+	r, ok := e.ranks[rank]
+	if !ok {
+		return false
+	}
+	i, ok := r.index[sheetID]
+	if !ok || !r.free.test(i) {
+		return false
+	}
+	r.free.clear(i)
+	r.remains--
+	return true
+}
+
+// AddEvent registers a new event whose sheets are all free.
+func (inv *Inventory) AddEvent(eventID int64, venue *Venue) {
+	e := newEventInventory(venue)
+	inv.mu.Lock()
+	inv.events[eventID] = e
+	inv.mu.Unlock()
+}
+
+// Relayout switches the event to the sheets of another venue. It fails
+// with errEventInUse unless every sheet of the event is free.
+func (inv *Inventory) Relayout(eventID int64, venue *Venue) error {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, r := range e.ranks {
+		if r.remains != len(r.sheets) {
+			return errEventInUse
+		}
+	}
+	e.ranks = newEventInventory(venue).ranks
+	return nil
+}
+
+func (inv *Inventory) event(eventID int64) (*eventInventory, error) {
+	inv.mu.RLock()
+	e, ok := inv.events[eventID]
+	inv.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownEvent
+	}
+	return e, nil
+}
+
+// Take picks a random free sheet of the rank and marks it as taken.
+func (inv *Inventory) Take(eventID int64, rank string) (*Sheet, error) {
+	sheets, _, err := inv.TakeN(eventID, rank, 1, false)
+	if err != nil {
+		return nil, err
+	}
+	return sheets[0], nil
+}
+
+// TakeN marks n free sheets of the rank as taken, all or nothing. When
+// adjacent is set it first looks for n sheets with consecutive numbers and
+// falls back to any free sheets; the second result reports whether the
+// returned sheets are adjacent.
+func (inv *Inventory) TakeN(eventID int64, rank string, n int, adjacent bool) ([]*Sheet, bool, error) {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, ok := e.ranks[rank]
+	if !ok {
+		return nil, false, errInvalidRank
+	}
+	if r.remains < n {
+		return nil, false, errSoldOut
+	}
+
+	start := rand.Intn(len(r.sheets))
+	var picked []int
+	if adjacent {
+		picked = r.findRun(start, n)
+	}
+	contiguous := picked != nil || n == 1
+	if picked == nil {
+		picked = make([]int, 0, n)
+		for i := r.free.next(start); len(picked) < n; i = r.free.next(i + 1) {
+			if i < 0 {
+				i = r.free.next(0)
+			}
+			picked = append(picked, i)
+		}
+	}
+
+	taken := make([]*Sheet, 0, n)
+	for _, i := range picked {
+		r.free.clear(i)
+		r.remains--
+		taken = append(taken, r.sheets[i])
+	}
+	return taken, contiguous, nil
+}
+
+// findRun returns the indexes of n consecutive free sheets, searching from
+// start and wrapping around, or nil if there is no such run.
+func (r *rankInventory) findRun(start, n int) []int {
+	for pass := 0; pass < 2; pass++ {
+		from, to := start, len(r.sheets)
+		if pass == 1 {
+			from, to = 0, start+n-1
+			if to > len(r.sheets) {
+				to = len(r.sheets)
+			}
+		}
+		run := 0
+		for i := from; i < to; i++ {
+			if !r.free.test(i) || (run > 0 && r.sheets[i].Num != r.sheets[i-1].Num+1) {
+				run = 0
+			}
+			if r.free.test(i) {
+				run++
+			}
+			if run == n {
+				picked := make([]int, n)
+				for j := range picked {
+					picked[j] = i - n + 1 + j
+				}
+				return picked
+			}
+		}
+	}
+	return nil
+}
+
+// Claim marks the given sheet as taken.
+func (inv *Inventory) Claim(eventID int64, sheet *Sheet) error {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.ranks[sheet.Rank]; !ok {
+		return errInvalidRank
+	}
+	if !e.take(sheet.Rank, sheet.ID) {
+		return errSheetTaken
+	}
+	return nil
+}
+
+// Release marks the sheet as free again. It reports false if the sheet was
+// not taken.
+func (inv *Inventory) Release(eventID int64, sheet *Sheet) bool {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, ok := e.ranks[sheet.Rank]
+	if !ok {
+		return false
+	}
+	i, ok := r.index[sheet.ID]
+	if !ok || r.free.test(i) {
+		return false
+	}
+	r.free.set(i)
+	r.remains++
+	return true
+}
+
+// ReleaseAll marks every sheet as free again.
+func (inv *Inventory) ReleaseAll(eventID int64, sheets []*Sheet) {
+	for _, sheet := range sheets {
+		inv.Release(eventID, sheet)
+	}
+}
+
+// Remains returns the number of free sheets of the event per rank.
+func (inv *Inventory) Remains(eventID int64) (map[string]int, error) {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	remains := make(map[string]int, len(e.ranks))
+	for rank, r := range e.ranks {
+		remains[rank] = r.remains
+	}
+	return remains, nil
+}
+
+// RankSnapshot is a point-in-time copy of the availability of one rank.
+type RankSnapshot struct {
+	Sheets  []*Sheet
+	Remains int
+	free    bitset
+}
+
+// Free reports whether the i-th sheet of the rank was free.
+func (s *RankSnapshot) Free(i int) bool {
+	return s.free.test(i)
+}
+
+// Snapshot copies the availability of every rank of the event.
+func (inv *Inventory) Snapshot(eventID int64) (map[string]*RankSnapshot, error) {
+	e, err := inv.event(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	snapshot := make(map[string]*RankSnapshot, len(e.ranks))
+	for rank, r := range e.ranks {
+		snapshot[rank] = &RankSnapshot{
+			Sheets:  r.sheets,
+			Remains: r.remains,
+			free:    append(bitset(nil), r.free...),
+		}
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// newTestVenue builds a venue in memory with n sheets per rank, numbered
+// from 1, whose sheet ids are unique across ranks.
+func newTestVenue(id int64, n int, ranks ...string) *Venue {
+	v := &Venue{ID: id}
+	var sheetID int64
+	for _, rank := range ranks {
+		r := &VenueRank{Rank: rank, Total: n}
+		for num := 1; num <= n; num++ {
+			sheetID++
+			r.sheets = append(r.sheets, &Sheet{ID: id*10000 + sheetID, Rank: rank, Num: int64(num)})
+		}
+		v.Ranks = append(v.Ranks, r)
+		v.Total += n
+	}
+	return v
+}
+
+func newTestInventory(venue *Venue) *Inventory {
+	inv := NewInventory()
+	inv.AddEvent(1, venue)
+	return inv
+}
+
+func TestTakeNAllOrNothing(t *testing.T) {
+	inv := newTestInventory(newTestVenue(1, 5, "S"))
+
+	if sheets, _, err := inv.TakeN(1, "S", 3, false); err != nil || len(sheets) != 3 {
+		t.Fatalf("TakeN(3) = %d sheets, %v", len(sheets), err)
+	}
+	if _, _, err := inv.TakeN(1, "S", 3, false); err != errSoldOut {
+		t.Fatalf("TakeN(3) with 2 left: got %v, want errSoldOut", err)
+	}
+	if remains, _ := inv.Remains(1); remains["S"] != 2 {
+		t.Fatalf("failed TakeN took sheets: remains = %d, want 2", remains["S"])
+	}
+	if sheets, _, err := inv.TakeN(1, "S", 2, false); err != nil || len(sheets) != 2 {
+		t.Fatalf("TakeN(2) = %d sheets, %v", len(sheets), err)
+	}
+	if _, err := inv.Take(1, "S"); err != errSoldOut {
+		t.Fatalf("Take on a sold out rank: got %v, want errSoldOut", err)
+	}
+
+	if _, _, err := inv.TakeN(1, "X", 1, false); err != errInvalidRank {
+		t.Errorf("unknown rank: got %v, want errInvalidRank", err)
+	}
+	if _, _, err := inv.TakeN(2, "S", 1, false); err != errUnknownEvent {
+		t.Errorf("unknown event: got %v, want errUnknownEvent", err)
+	}
+}
+
+func TestTakeNDistinctSheets(t *testing.T) {
+	venue := newTestVenue(1, 50, "S")
+	inv := newTestInventory(venue)
+
+	seen := map[int64]bool{}
+	for i := 0; i < 10; i++ {
+		sheets, _, err := inv.TakeN(1, "S", 5, i%2 == 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sheet := range sheets {
+			if seen[sheet.ID] {
+				t.Fatalf("sheet %d taken twice", sheet.Num)
+			}
+			seen[sheet.ID] = true
+		}
+	}
+	if len(seen) != 50 {
+		t.Fatalf("took %d sheets, want 50", len(seen))
+	}
+}
+
+// takeAllBut leaves only the given sheet numbers of the rank free.
+func takeAllBut(t *testing.T, inv *Inventory, venue *Venue, rank string, free ...int64) {
+	t.Helper()
+	keep := map[int64]bool{}
+	for _, num := range free {
+		keep[num] = true
+	}
+	r, _ := venue.Rank(rank)
+	for _, sheet := range r.sheets {
+		if !keep[sheet.Num] {
+			if err := inv.Claim(1, sheet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFindRun(t *testing.T) {
+	venue := newTestVenue(1, 10, "S")
+	inv := newTestInventory(venue)
+	takeAllBut(t, inv, venue, "S", 2, 3, 4, 6, 8, 9)
+	r := inv.events[1].ranks["S"]
+
+	nums := func(picked []int) []int64 {
+		var list []int64
+		for _, i := range picked {
+			list = append(list, r.sheets[i].Num)
+		}
+		return list
+	}
+	for _, tc := range []struct {
+		start, n int
+		want     []int64
+	}{
+		{0, 3, []int64{2, 3, 4}},
+		{4, 2, []int64{8, 9}},
+		{8, 3, []int64{2, 3, 4}}, // wraps around to the start
+		{9, 2, []int64{2, 3}},
+		{0, 4, nil},
+	} {
+		got := nums(r.findRun(tc.start, tc.n))
+		if len(got) != len(tc.want) {
+			t.Errorf("findRun(%d, %d) = %v, want %v", tc.start, tc.n, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("findRun(%d, %d) = %v, want %v", tc.start, tc.n, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFindRunNeedsConsecutiveNumbers(t *testing.T) {
+	r := newRankInventory([]*Sheet{{ID: 1, Num: 1}, {ID: 2, Num: 2}, {ID: 3, Num: 4}, {ID: 4, Num: 5}})
+	if picked := r.findRun(0, 3); picked != nil {
+		t.Fatalf("findRun across a gap in numbers = %v, want nil", picked)
+	}
+	if picked := r.findRun(0, 2); len(picked) != 2 || picked[0] != 0 {
+		t.Fatalf("findRun(0, 2) = %v, want [0 1]", picked)
+	}
+}
+
+func TestTakeNAdjacentFallback(t *testing.T) {
+	venue := newTestVenue(1, 10, "S")
+	inv := newTestInventory(venue)
+	takeAllBut(t, inv, venue, "S", 1, 3, 5, 7)
+
+	sheets, adjacent, err := inv.TakeN(1, "S", 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adjacent || len(sheets) != 3 {
+		t.Fatalf("TakeN without a run = %d sheets, adjacent %v; want 3 sheets, not adjacent", len(sheets), adjacent)
+	}
+
+	inv = newTestInventory(venue)
+	sheets, adjacent, err = inv.TakeN(1, "S", 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !adjacent {
+		t.Fatal("TakeN on a free rank did not return adjacent sheets")
+	}
+	for i := 1; i < len(sheets); i++ {
+		if sheets[i].Num != sheets[i-1].Num+1 {
+			t.Fatalf("sheets %d and %d are not adjacent", sheets[i-1].Num, sheets[i].Num)
+		}
+	}
+}
+
+func TestClaimRelease(t *testing.T) {
+	venue := newTestVenue(1, 3, "S")
+	inv := newTestInventory(venue)
+	sheet, _ := venue.Sheet("S", 2)
+
+	if err := inv.Claim(1, sheet); err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Claim(1, sheet); err != errSheetTaken {
+		t.Fatalf("second Claim: got %v, want errSheetTaken", err)
+	}
+	if !inv.Release(1, sheet) {
+		t.Fatal("Release of a taken sheet reported false")
+	}
+	if inv.Release(1, sheet) {
+		t.Fatal("second Release reported true")
+	}
+	if remains, _ := inv.Remains(1); remains["S"] != 3 {
+		t.Fatalf("remains = %d after double release, want 3", remains["S"])
+	}
+
+	other := newTestVenue(2, 1, "X")
+	if err := inv.Claim(1, other.Ranks[0].sheets[0]); err != errInvalidRank {
+		t.Fatalf("Claim of another venue's sheet: got %v, want errInvalidRank", err)
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	venue := newTestVenue(1, 3, "S")
+	inv := newTestInventory(venue)
+	sheet, _ := venue.Sheet("S", 1)
+	if err := inv.Claim(1, sheet); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestVenue(2, 4, "A", "B")
+	if err := inv.Relayout(1, other); err != errEventInUse {
+		t.Fatalf("Relayout with a taken sheet: got %v, want errEventInUse", err)
+	}
+	inv.Release(1, sheet)
+	if err := inv.Relayout(1, other); err != nil {
+		t.Fatal(err)
+	}
+	remains, _ := inv.Remains(1)
+	if len(remains) != 2 || remains["A"] != 4 || remains["B"] != 4 {
+		t.Fatalf("remains after Relayout = %v", remains)
+	}
+	if err := inv.Relayout(2, other); err != errUnknownEvent {
+		t.Fatalf("Relayout of an unknown event: got %v, want errUnknownEvent", err)
+	}
+}
+
+func TestSnapshotIsACopy(t *testing.T) {
+	venue := newTestVenue(1, 3, "S")
+	inv := newTestInventory(venue)
+
+	snapshot, err := inv.Snapshot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet, _ := venue.Sheet("S", 1)
+	if err := inv.Claim(1, sheet); err != nil {
+		t.Fatal(err)
+	}
+	if s := snapshot["S"]; s.Remains != 3 || !s.Free(0) {
+		t.Fatalf("snapshot changed with the inventory: remains %d, sheet 1 free %v", s.Remains, s.Free(0))
+	}
+	if after, _ := inv.Snapshot(1); after["S"].Remains != 2 || after["S"].Free(0) {
+		t.Fatal("new snapshot does not see the claimed sheet")
+	}
+}
+
+func TestInventoryConcurrent(t *testing.T) {
+	venue := newTestVenue(1, 200, "S", "A")
+	inv := newTestInventory(venue)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held := map[int64]bool{}
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rank := []string{"S", "A"}[i%2]
+			sheets, _, err := inv.TakeN(1, rank, 1+i%4, i%3 == 0)
+			if err != nil {
+				return
+			}
+			if i%5 == 0 {
+				inv.ReleaseAll(1, sheets)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, sheet := range sheets {
+				if held[sheet.ID] {
+					t.Errorf("sheet %s-%d taken twice", sheet.Rank, sheet.Num)
+				}
+				held[sheet.ID] = true
+			}
+		}(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inv.Snapshot(1)
+		}()
+	}
+	wg.Wait()
+
+	remains, _ := inv.Remains(1)
+	if taken := 400 - remains["S"] - remains["A"]; taken != len(held) {
+		t.Fatalf("inventory has %d sheets taken, goroutines hold %d", taken, len(held))
+	}
+}
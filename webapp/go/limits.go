@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var errLimitExceeded = errors.New("reservation: purchase limit exceeded")
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadRankLimits returns the per rank limits of sheets a user may hold for
+// the event. Ranks without a limit are absent.
+func loadRankLimits(q queryer, eventID int64) (map[string]int64, error) {
+	rows, err := q.Query("SELECT `rank`, max_per_user FROM event_rank_limits WHERE event_id = ?", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := map[string]int64{}
+	for rows.Next() {
+		var rank string
+		var limit int64
+		if err := rows.Scan(&rank, &limit); err != nil {
+			return nil, err
+		}
+		limits[rank] = limit
+	}
+	return limits, rows.Err()
+}
+
+// saveRankLimits replaces the per rank limits of the event. Zero limits
+// are dropped.
+func saveRankLimits(tx *sql.Tx, eventID int64, limits map[string]int64) error {
+	if _, err := tx.Exec("DELETE FROM event_rank_limits WHERE event_id = ?", eventID); err != nil {
+		return err
+	}
+	for rank, limit := range limits {
+		if limit == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO event_rank_limits (event_id, `rank`, max_per_user) VALUES (?, ?, ?)", eventID, rank, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validLimits reports whether the limits are non-negative and only name
+// ranks of the venue.
+func validLimits(venue *Venue, maxPerUser int64, rankLimits map[string]int64) bool {
+	if maxPerUser < 0 {
+		return false
+	}
+	for rank, limit := range rankLimits {
+		if _, ok := venue.Rank(rank); !ok || limit < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPurchaseLimits fails with errLimitExceeded when buying sheets would
+// leave the user with more active reservations and held sheets of the
+// event, overall or of a rank, than the event allows. The user row is
+// locked so that concurrent purchases and holds of one user are counted one
+// after another.
+func checkPurchaseLimits(tx *sql.Tx, event *Event, userID int64, sheets []*Sheet) error {
+	rankLimits, err := loadRankLimits(tx, event.ID)
+	if err != nil {
+		return err
+	}
+	if event.MaxPerUser == 0 && len(rankLimits) == 0 {
+		return nil
+	}
+
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&id); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT s.`rank`, COUNT(*) FROM reservations r JOIN sheets s ON s.id = r.sheet_id WHERE r.event_id = ? AND r.user_id = ? AND r.canceled_at IS NULL GROUP BY s.`rank`", event.ID, userID)
+	if err != nil {
+		return err
+	}
+	counts := map[string]int64{}
+	var total int64
+	for rows.Next() {
+		var rank string
+		var n int64
+		if err := rows.Scan(&rank, &n); err != nil {
+			rows.Close()
+			return err
+		}
+		counts[rank] = n
+		total += n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, sheet := range append(holds.Held(event.ID, userID), sheets...) {
+		counts[sheet.Rank]++
+		total++
+	}
+	if event.MaxPerUser > 0 && total > event.MaxPerUser {
+		return errLimitExceeded
+	}
+	for rank, limit := range rankLimits {
+		if counts[rank] > limit {
+			return errLimitExceeded
+		}
+	}
+	return nil
+}
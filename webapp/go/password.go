@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher is one password hashing scheme. Stored hashes carry a
+// prefix identifying their scheme so several schemes can coexist in the
+// users and administrators tables.
+type PasswordHasher interface {
+	Name() string
+	Hash(password string) (string, error)
+	// Match reports whether hash was produced by this scheme.
+	Match(hash string) bool
+	Verify(hash, password string) bool
+}
+
+// sha256Hasher verifies the unsalted SHA2(?, 256) hashes MySQL used to
+// compute. They have no prefix; new hashes are never produced with it.
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string { return "sha256" }
+
+func (sha256Hasher) Hash(password string) (string, error) {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (sha256Hasher) Match(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+func (h sha256Hasher) Verify(hash, password string) bool {
+	sum, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(sum)) == 1
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (bcryptHasher) Name() string { return "bcrypt" }
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(b), err
+}
+
+func (bcryptHasher) Match(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (bcryptHasher) Verify(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// argon2idHasher stores hashes in the PHC string format:
+// $argon2id$v=19$m=<KiB>,t=<time>,p=<threads>$<salt>$<key>
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (argon2idHasher) Name() string { return "argon2id" }
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (argon2idHasher) Match(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+func (argon2idHasher) Verify(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+var passwordHashers = []PasswordHasher{
+	bcryptHasher{cost: bcrypt.DefaultCost},
+	argon2idHasher{time: 2, memory: 19 * 1024, threads: 1, keyLen: 32},
+	sha256Hasher{},
+}
+
+// passwordHasher hashes new passwords. It is chosen with PASSWORD_HASHER.
+var passwordHasher = passwordHashers[0]
+
+func setPasswordHasher() error {
+	name := os.Getenv("PASSWORD_HASHER")
+	if name == "" {
+		return nil
+	}
+	for _, h := range passwordHashers {
+		if h.Name() == name && h.Name() != "sha256" {
+			passwordHasher = h
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown PASSWORD_HASHER %q", name)
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// verifyPassword checks password against a stored hash of any known
+// scheme. rehash is set when the hash should be upgraded to the preferred
+// scheme now that the plain password is at hand.
+func verifyPassword(hash, password string) (ok bool, rehash bool) {
+	for _, h := range passwordHashers {
+		if h.Match(hash) {
+			ok = h.Verify(hash, password)
+			return ok, ok && h.Name() != passwordHasher.Name()
+		}
+	}
+	return false, false
+}
+
+// upgradePasswordHash rewrites a legacy hash after a successful login.
+// Failures are only logged since the login itself succeeded.
+func upgradePasswordHash(table string, id int64, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Println("rehash password:", err)
+		return
+	}
+	if _, err := db.Exec("UPDATE "+table+" SET pass_hash = ? WHERE id = ?", hash, id); err != nil {
+		log.Println("rehash password:", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHashers are the schemes of passwordHashers with cheap parameters.
+var testHashers = []PasswordHasher{
+	bcryptHasher{cost: bcrypt.MinCost},
+	argon2idHasher{time: 1, memory: 64, threads: 1, keyLen: 32},
+	sha256Hasher{},
+}
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	for _, h := range testHashers {
+		hash, err := h.Hash("s3cret")
+		if err != nil {
+			t.Fatalf("%s: Hash: %v", h.Name(), err)
+		}
+		if !h.Match(hash) {
+			t.Errorf("%s: Match(%q) = false", h.Name(), hash)
+		}
+		if !h.Verify(hash, "s3cret") {
+			t.Errorf("%s: Verify of the password = false", h.Name())
+		}
+		if h.Verify(hash, "s3cret!") {
+			t.Errorf("%s: Verify of a wrong password = true", h.Name())
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	defer func(h PasswordHasher) { passwordHasher = h }(passwordHasher)
+	passwordHasher = passwordHashers[0]
+
+	hash := func(h PasswordHasher) string {
+		s, err := h.Hash("s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	bcryptHash := hash(testHashers[0])
+	argon2Hash := hash(testHashers[1])
+	parts := strings.Split(argon2Hash, "$")
+
+	for _, tc := range []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"preferred scheme", bcryptHash, "s3cret", true, false},
+		{"other scheme", argon2Hash, "s3cret", true, true},
+		{"legacy sha2", hash(testHashers[2]), "s3cret", true, true},
+		{"legacy sha2 in upper case", strings.ToUpper(hash(testHashers[2])), "s3cret", true, true},
+		{"wrong password", bcryptHash, "secret", false, false},
+		{"wrong password of legacy sha2", hash(testHashers[2]), "secret", false, false},
+		{"wrong password of argon2", argon2Hash, "secret", false, false},
+		{"argon2 missing the key", strings.Join(parts[:5], "$"), "s3cret", false, false},
+		{"argon2 of another version", strings.Replace(argon2Hash, "v=19", "v=16", 1), "s3cret", false, false},
+		{"argon2 with bad parameters", strings.Replace(argon2Hash, parts[3], "m=x,t=1,p=1", 1), "s3cret", false, false},
+		{"argon2 with a bad salt", strings.Replace(argon2Hash, parts[4], "!!", 1), "s3cret", false, false},
+		{"unknown scheme", "plain:s3cret", "s3cret", false, false},
+		{"empty hash", "", "", false, false},
+	} {
+		ok, rehash := verifyPassword(tc.hash, tc.password)
+		if ok != tc.ok || rehash != tc.rehash {
+			t.Errorf("%s: verifyPassword = %v, %v; want %v, %v", tc.name, ok, rehash, tc.ok, tc.rehash)
+		}
+	}
+}
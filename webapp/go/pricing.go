@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Pricing rule kinds.
+const (
+	// RuleOverride replaces the list price of the rank with Amount.
+	RuleOverride = "override"
+	// RuleEarlyBird discounts sales made before Until.
+	RuleEarlyBird = "early_bird"
+	// RuleDemand adds a surcharge while fewer than RemainsBelow sheets of
+	// the rank are left.
+	RuleDemand = "demand"
+)
+
+// PricingRule adjusts the price of the sheets of an event, or only of one
+// rank when Rank is set. Discounts and surcharges are either a fixed
+// Amount or a Percent of the list price.
+type PricingRule struct {
+	ID           int64      `json:"id"`
+	EventID      int64      `json:"event_id"`
+	Rank         string     `json:"rank,omitempty"`
+	Kind         string     `json:"kind"`
+	Amount       int64      `json:"amount,omitempty"`
+	Percent      int64      `json:"percent,omitempty"`
+	Until        *time.Time `json:"-"`
+	RemainsBelow int        `json:"remains_below,omitempty"`
+
+	UntilUnix int64 `json:"until,omitempty"`
+}
+
+func loadPricingRules(q queryer, eventID int64) ([]*PricingRule, error) {
+	rules, err := loadEventsPricingRules(q, []int64{eventID})
+	return rules[eventID], err
+}
+
+// loadEventsPricingRules loads the rules of several events in one query,
+// keyed by event id.
+func loadEventsPricingRules(q queryer, eventIDs []int64) (map[int64][]*PricingRule, error) {
+	rules := map[int64][]*PricingRule{}
+	if len(eventIDs) == 0 {
+		return rules, nil
+	}
+	args := make([]interface{}, len(eventIDs))
+	for i, id := range eventIDs {
+		args[i] = id
+	}
+	rows, err := q.Query("SELECT id, event_id, IFNULL(`rank`, ''), kind, amount, percent, until, remains_below FROM pricing_rules WHERE event_id IN (?"+strings.Repeat(", ?", len(eventIDs)-1)+") ORDER BY id ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := &PricingRule{}
+		if err := rows.Scan(&r.ID, &r.EventID, &r.Rank, &r.Kind, &r.Amount, &r.Percent, &r.Until, &r.RemainsBelow); err != nil {
+			return nil, err
+		}
+		r.UntilUnix = unixOrZero(r.Until)
+		rules[r.EventID] = append(rules[r.EventID], r)
+	}
+	return rules, rows.Err()
+}
+
+// Pricer quotes the prices of the sheets of one event.
+type Pricer struct {
+	event *Event
+	rules []*PricingRule
+}
+
+func newPricer(q queryer, event *Event) (*Pricer, error) {
+	rules, err := loadPricingRules(q, event.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Pricer{event: event, rules: rules}, nil
+}
+
+func (r *PricingRule) adjustment(list int64) int64 {
+	if r.Percent != 0 {
+		return list * r.Percent / 100
+	}
+	return r.Amount
+}
+
+// Price returns the price of a sheet of the rank at now, while remains
+// sheets of the rank are free. The list price is the event price plus the
+// rank surcharge unless overridden; early bird discounts and demand
+// surcharges are applied on top of it. Prices never drop below zero.
+func (p *Pricer) Price(rank string, rankPrice int64, remains int, now time.Time) int64 {
+	list := p.event.Price + rankPrice
+	for _, r := range p.rules {
+		if r.Kind == RuleOverride && (r.Rank == "" || r.Rank == rank) {
+			list = r.Amount
+		}
+	}
+
+	price := list
+	for _, r := range p.rules {
+		if r.Rank != "" && r.Rank != rank {
+			continue
+		}
+		switch r.Kind {
+		case RuleEarlyBird:
+			if r.Until != nil && now.Before(*r.Until) {
+				price -= r.adjustment(list)
+			}
+		case RuleDemand:
+			if remains < r.RemainsBelow {
+				price += r.adjustment(list)
+			}
+		}
+	}
+	if price < 0 {
+		price = 0
+	}
+	return price
+}
+
+func validPricingRule(venue *Venue, r *PricingRule) bool {
+	if r.Rank != "" {
+		if _, ok := venue.Rank(r.Rank); !ok {
+			return false
+		}
+	}
+	if r.Amount < 0 || r.Percent < 0 || r.Percent > 100 {
+		return false
+	}
+	switch r.Kind {
+	case RuleOverride:
+		return r.Percent == 0
+	case RuleEarlyBird:
+		return r.Until != nil && (r.Amount == 0) != (r.Percent == 0)
+	case RuleDemand:
+		return r.RemainsBelow > 0 && (r.Amount == 0) != (r.Percent == 0)
+	}
+	return false
+}
+
+func getAdminPricingRulesHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	rules, err := loadPricingRules(db, eventID)
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		rules = make([]*PricingRule, 0)
+	}
+	return c.JSON(200, rules)
+}
+
+func addAdminPricingRuleHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank         string `json:"rank"`
+		Kind         string `json:"kind"`
+		Amount       int64  `json:"amount"`
+		Percent      int64  `json:"percent"`
+		Until        int64  `json:"until"`
+		RemainsBelow int    `json:"remains_below"`
+	}
+	c.Bind(&params)
+
+	var event Event
+	if err := scanEvent(db.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", eventID), &event); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+	venue, ok := getVenue(event.VenueID)
+	if !ok {
+		return resError(c, "invalid_venue", 400)
+	}
+
+	rule := &PricingRule{
+		EventID:      event.ID,
+		Rank:         params.Rank,
+		Kind:         params.Kind,
+		Amount:       params.Amount,
+		Percent:      params.Percent,
+		Until:        timeFromUnix(params.Until),
+		RemainsBelow: params.RemainsBelow,
+		UntilUnix:    params.Until,
+	}
+	if !validPricingRule(venue, rule) {
+		return resError(c, "invalid_rule", 400)
+	}
+
+	var rank interface{}
+	if rule.Rank != "" {
+		rank = rule.Rank
+	}
+	res, err := db.Exec("INSERT INTO pricing_rules (event_id, `rank`, kind, amount, percent, until, remains_below) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rule.EventID, rank, rule.Kind, rule.Amount, rule.Percent, nullTime(rule.Until), rule.RemainsBelow)
+	if err != nil {
+		return err
+	}
+	if rule.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	return c.JSON(201, rule)
+}
+
+func removeAdminPricingRuleHandler(c echo.Context) error {
+	res, err := db.Exec("DELETE FROM pricing_rules WHERE id = ? AND event_id = ?", c.Param("rule_id"), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "not_found", 404)
+	}
+	return c.NoContent(204)
+}
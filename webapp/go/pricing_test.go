@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPricerPrice(t *testing.T) {
+	now := time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	event := &Event{Price: 1000}
+
+	for _, tc := range []struct {
+		name  string
+		rules []*PricingRule
+		want  int64
+	}{
+		{"list price", nil, 6000},
+		{"override", []*PricingRule{{Kind: RuleOverride, Rank: "S", Amount: 4000}}, 4000},
+		{"override of another rank", []*PricingRule{{Kind: RuleOverride, Rank: "A", Amount: 4000}}, 6000},
+		{"early bird", []*PricingRule{{Kind: RuleEarlyBird, Percent: 10, Until: &later}}, 5400},
+		{"early bird over", []*PricingRule{{Kind: RuleEarlyBird, Amount: 500, Until: &now}}, 6000},
+		{"demand", []*PricingRule{{Kind: RuleDemand, Amount: 500, RemainsBelow: 10}}, 6500},
+		{"demand not reached", []*PricingRule{{Kind: RuleDemand, Amount: 500, RemainsBelow: 5}}, 6000},
+		{"never negative", []*PricingRule{{Kind: RuleEarlyBird, Amount: 9000, Until: &later}}, 0},
+	} {
+		p := &Pricer{event: event, rules: tc.rules}
+		if got := p.Price("S", 5000, 5, now); got != tc.want {
+			t.Errorf("%s: Price = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
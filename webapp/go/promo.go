@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errPromoInvalid   = errors.New("promo: invalid code")
+	errPromoExhausted = errors.New("promo: no uses left")
+)
+
+// Promo code discount kinds.
+const (
+	PromoPercent = "percent"
+	PromoFixed   = "fixed"
+)
+
+// PromoCode discounts every sheet of a reservation by a Percent or a fixed
+// Amount. A redemption is one reserve request; MaxUses and MaxUsesPerUser
+// cap them when non-zero. EventID and Rank, when set, limit the code to
+// one event or rank.
+type PromoCode struct {
+	ID             int64      `json:"id"`
+	Code           string     `json:"code"`
+	Kind           string     `json:"kind"`
+	Amount         int64      `json:"amount"`
+	MaxUses        int64      `json:"max_uses"`
+	MaxUsesPerUser int64      `json:"max_uses_per_user"`
+	UsedCount      int64      `json:"used_count"`
+	ValidFrom      *time.Time `json:"-"`
+	ValidUntil     *time.Time `json:"-"`
+	EventID        int64      `json:"event_id,omitempty"`
+	Rank           string     `json:"rank,omitempty"`
+
+	ValidFromUnix  int64 `json:"valid_from,omitempty"`
+	ValidUntilUnix int64 `json:"valid_until,omitempty"`
+}
+
+const promoCodeColumns = "id, code, kind, amount, max_uses, max_uses_per_user, used_count, valid_from, valid_until, IFNULL(event_id, 0), IFNULL(`rank`, '')"
+
+func scanPromoCode(s rowScanner, p *PromoCode) error {
+	if err := s.Scan(&p.ID, &p.Code, &p.Kind, &p.Amount, &p.MaxUses, &p.MaxUsesPerUser, &p.UsedCount, &p.ValidFrom, &p.ValidUntil, &p.EventID, &p.Rank); err != nil {
+		return err
+	}
+	p.ValidFromUnix = unixOrZero(p.ValidFrom)
+	p.ValidUntilUnix = unixOrZero(p.ValidUntil)
+	return nil
+}
+
+// Discount returns the discount on a sheet sold for price.
+func (p *PromoCode) Discount(price int64) int64 {
+	discount := p.Amount
+	if p.Kind == PromoPercent {
+		discount = price * p.Amount / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	return discount
+}
+
+// redeemPromoCode locks the code in tx, checks that it applies to the
+// sheets and the user still has uses left, and counts the redemption.
+func redeemPromoCode(tx *sql.Tx, code string, event *Event, userID int64, sheets []*Sheet, now time.Time) (*PromoCode, error) {
+	var p PromoCode
+	if err := scanPromoCode(tx.QueryRow("SELECT "+promoCodeColumns+" FROM promo_codes WHERE code = ? FOR UPDATE", code), &p); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errPromoInvalid
+		}
+		return nil, err
+	}
+
+	if p.ValidFrom != nil && now.Before(*p.ValidFrom) || p.ValidUntil != nil && !now.Before(*p.ValidUntil) {
+		return nil, errPromoInvalid
+	}
+	if p.EventID != 0 && p.EventID != event.ID {
+		return nil, errPromoInvalid
+	}
+	for _, sheet := range sheets {
+		if p.Rank != "" && p.Rank != sheet.Rank {
+			return nil, errPromoInvalid
+		}
+	}
+
+	if p.MaxUses > 0 && p.UsedCount >= p.MaxUses {
+		return nil, errPromoExhausted
+	}
+	if p.MaxUsesPerUser > 0 {
+		var used int64
+		if err := tx.QueryRow("SELECT COUNT(*) FROM promo_redemptions WHERE promo_code_id = ? AND user_id = ?", p.ID, userID).Scan(&used); err != nil {
+			return nil, err
+		}
+		if used >= p.MaxUsesPerUser {
+			return nil, errPromoExhausted
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE promo_codes SET used_count = used_count + 1 WHERE id = ?", p.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO promo_redemptions (promo_code_id, user_id, event_id, created_at) VALUES (?, ?, ?, ?)",
+		p.ID, userID, event.ID, now.UTC().Format("2006-01-02 15:04:05.000000")); err != nil {
+		return nil, err
+	}
+	p.UsedCount++
+	return &p, nil
+}
+
+var promoCodeNames sync.Map // promo code id -> code
+
+// promoCodeName returns the code of a promo code for reports. Codes never
+// change, so they are cached.
+func promoCodeName(id int64) string {
+	if v, ok := promoCodeNames.Load(id); ok {
+		return v.(string)
+	}
+	var code string
+	if err := db.QueryRow("SELECT code FROM promo_codes WHERE id = ?", id).Scan(&code); err != nil {
+		return ""
+	}
+	promoCodeNames.Store(id, code)
+	return code
+}
+
+var promoCodePattern = regexp.MustCompile(`^[0-9A-Z_-]{3,32}$`)
+
+type promoCodeParams struct {
+	Code           string `json:"code"`
+	Kind           string `json:"kind"`
+	Amount         int64  `json:"amount"`
+	MaxUses        int64  `json:"max_uses"`
+	MaxUsesPerUser int64  `json:"max_uses_per_user"`
+	ValidFrom      int64  `json:"valid_from"`
+	ValidUntil     int64  `json:"valid_until"`
+	EventID        int64  `json:"event_id"`
+	Rank           string `json:"rank"`
+}
+
+// promoCode validates the parameters and returns the promo code they
+// describe, or an error code for resError.
+func (params *promoCodeParams) promoCode() (*PromoCode, string) {
+	p := &PromoCode{
+		Code:           strings.ToUpper(strings.TrimSpace(params.Code)),
+		Kind:           params.Kind,
+		Amount:         params.Amount,
+		MaxUses:        params.MaxUses,
+		MaxUsesPerUser: params.MaxUsesPerUser,
+		ValidFrom:      timeFromUnix(params.ValidFrom),
+		ValidUntil:     timeFromUnix(params.ValidUntil),
+		EventID:        params.EventID,
+		Rank:           params.Rank,
+		ValidFromUnix:  params.ValidFrom,
+		ValidUntilUnix: params.ValidUntil,
+	}
+	if !promoCodePattern.MatchString(p.Code) {
+		return nil, "invalid_code"
+	}
+	switch {
+	case p.Kind == PromoPercent && (p.Amount <= 0 || p.Amount > 100):
+		return nil, "invalid_amount"
+	case p.Kind == PromoFixed && p.Amount <= 0:
+		return nil, "invalid_amount"
+	case p.Kind != PromoPercent && p.Kind != PromoFixed:
+		return nil, "invalid_kind"
+	case p.MaxUses < 0 || p.MaxUsesPerUser < 0:
+		return nil, "invalid_max_uses"
+	case p.ValidFrom != nil && p.ValidUntil != nil && !p.ValidFrom.Before(*p.ValidUntil):
+		return nil, "invalid_validity"
+	}
+
+	if p.EventID != 0 {
+		var venueID int64
+		if err := db.QueryRow("SELECT venue_id FROM events WHERE id = ?", p.EventID).Scan(&venueID); err != nil {
+			return nil, "invalid_event"
+		}
+		venue, ok := getVenue(venueID)
+		if !ok {
+			return nil, "invalid_event"
+		}
+		if p.Rank != "" {
+			if _, ok := venue.Rank(p.Rank); !ok {
+				return nil, "invalid_rank"
+			}
+		}
+	} else if p.Rank != "" && !anyVenueHasRank(p.Rank) {
+		// A code for any event could otherwise never apply to a sheet.
+		return nil, "invalid_rank"
+	}
+	return p, ""
+}
+
+func nullInt64(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+func getAdminPromoCodesHandler(c echo.Context) error {
+	rows, err := db.Query("SELECT " + promoCodeColumns + " FROM promo_codes ORDER BY id ASC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	codes := make([]*PromoCode, 0)
+	for rows.Next() {
+		var p PromoCode
+		if err := scanPromoCode(rows, &p); err != nil {
+			return err
+		}
+		codes = append(codes, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, codes)
+}
+
+func getAdminPromoCodeHandler(c echo.Context) error {
+	var p PromoCode
+	if err := scanPromoCode(db.QueryRow("SELECT "+promoCodeColumns+" FROM promo_codes WHERE id = ?", c.Param("id")), &p); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+	return c.JSON(200, p)
+}
+
+func addAdminPromoCodeHandler(c echo.Context) error {
+	var params promoCodeParams
+	c.Bind(&params)
+
+	p, errCode := params.promoCode()
+	if errCode != "" {
+		return resError(c, errCode, 400)
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM promo_codes WHERE code = ?", p.Code).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return resError(c, "duplicated", 409)
+	}
+
+	res, err := db.Exec("INSERT INTO promo_codes (code, kind, amount, max_uses, max_uses_per_user, valid_from, valid_until, event_id, `rank`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		p.Code, p.Kind, p.Amount, p.MaxUses, p.MaxUsesPerUser, nullTime(p.ValidFrom), nullTime(p.ValidUntil), nullInt64(p.EventID), nullString(p.Rank))
+	if err != nil {
+		return err
+	}
+	if p.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	return c.JSON(201, p)
+}
+
+// editAdminPromoCodeHandler replaces everything but the code itself and
+// its usage count.
+func editAdminPromoCodeHandler(c echo.Context) error {
+	promoCodeID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	var current PromoCode
+	if err := scanPromoCode(db.QueryRow("SELECT "+promoCodeColumns+" FROM promo_codes WHERE id = ?", promoCodeID), &current); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+
+	var params promoCodeParams
+	c.Bind(&params)
+	params.Code = current.Code
+
+	p, errCode := params.promoCode()
+	if errCode != "" {
+		return resError(c, errCode, 400)
+	}
+
+	if _, err := db.Exec("UPDATE promo_codes SET kind = ?, amount = ?, max_uses = ?, max_uses_per_user = ?, valid_from = ?, valid_until = ?, event_id = ?, `rank` = ? WHERE id = ?",
+		p.Kind, p.Amount, p.MaxUses, p.MaxUsesPerUser, nullTime(p.ValidFrom), nullTime(p.ValidUntil), nullInt64(p.EventID), nullString(p.Rank), promoCodeID); err != nil {
+		return err
+	}
+	p.ID = promoCodeID
+	p.UsedCount = current.UsedCount
+	return c.JSON(200, p)
+}
+
+// removeAdminPromoCodeHandler deletes a promo code that was never used.
+// Used codes stay for the reports; end their validity instead.
+func removeAdminPromoCodeHandler(c echo.Context) error {
+	res, err := db.Exec("DELETE FROM promo_codes WHERE id = ? AND used_count = 0", c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM promo_codes WHERE id = ?", c.Param("id")).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return resError(c, "promo_code_in_use", 409)
+		}
+		return resError(c, "not_found", 404)
+	}
+	return c.NoContent(204)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Report row types: a sale of a reservation by the organizer, or a resale
+// of one between users.
+const (
+	reportSale   = "sale"
+	reportResale = "resale"
+)
+
+type Report struct {
+	ReservationID int64  `json:"reservation_id"`
+	EventID       int64  `json:"event_id"`
+	Rank          string `json:"rank"`
+	Num           int64  `json:"num"`
+	UserID        int64  `json:"user_id"`
+	SoldAt        string `json:"sold_at"`
+	CanceledAt    string `json:"canceled_at"`
+	Price         int64  `json:"price"`
+	Discount      int64  `json:"discount"`
+	PromoCode     string `json:"promo_code"`
+	Type          string `json:"type"`
+	SellerID      int64  `json:"seller_id,omitempty"`
+}
+
+// ReportFilter narrows a sales report. Zero values match every
+// reservation; the ranges include From and exclude To.
+type ReportFilter struct {
+	EventID      int64
+	SoldFrom     *time.Time
+	SoldTo       *time.Time
+	CanceledFrom *time.Time
+	CanceledTo   *time.Time
+	Rank         string
+	UserID       int64
+	Status       string // "", "active" or "canceled"
+}
+
+var errInvalidReportFilter = errors.New("report: invalid filter")
+
+// parseReportTime accepts RFC 3339 timestamps or plain dates, which are
+// taken as midnight UTC.
+func parseReportTime(v string) (*time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", v); err != nil {
+			return nil, errInvalidReportFilter
+		}
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// parseReportFilter reads the query parameters sold_from, sold_to,
+// canceled_from, canceled_to, rank, user_id and status.
+func parseReportFilter(c echo.Context) (*ReportFilter, error) {
+	var f ReportFilter
+	var err error
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"sold_from", &f.SoldFrom},
+		{"sold_to", &f.SoldTo},
+		{"canceled_from", &f.CanceledFrom},
+		{"canceled_to", &f.CanceledTo},
+	} {
+		if v := c.QueryParam(p.name); v != "" {
+			if *p.dst, err = parseReportTime(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	f.Rank = c.QueryParam("rank")
+	if v := c.QueryParam("user_id"); v != "" {
+		if f.UserID, err = strconv.ParseInt(v, 10, 64); err != nil || f.UserID <= 0 {
+			return nil, errInvalidReportFilter
+		}
+	}
+	switch f.Status = c.QueryParam("status"); f.Status {
+	case "", "active", "canceled":
+	default:
+		return nil, errInvalidReportFilter
+	}
+	return &f, nil
+}
+
+// where returns the SQL condition on reservations selecting the filtered
+// rows, with its arguments.
+func (f *ReportFilter) where() (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+
+	if f.EventID != 0 {
+		add("event_id = ?", f.EventID)
+	}
+	if f.SoldFrom != nil {
+		add("reserved_at >= ?", f.SoldFrom.Format("2006-01-02 15:04:05.000000"))
+	}
+	if f.SoldTo != nil {
+		add("reserved_at < ?", f.SoldTo.Format("2006-01-02 15:04:05.000000"))
+	}
+	if f.CanceledFrom != nil {
+		add("canceled_at >= ?", f.CanceledFrom.Format("2006-01-02 15:04:05.000000"))
+	}
+	if f.CanceledTo != nil {
+		add("canceled_at < ?", f.CanceledTo.Format("2006-01-02 15:04:05.000000"))
+	}
+	if f.Rank != "" {
+		add("sheet_id IN (SELECT id FROM sheets WHERE `rank` = ?)", f.Rank)
+	}
+	if f.UserID != 0 {
+		add("user_id = ?", f.UserID)
+	}
+	switch f.Status {
+	case "active":
+		conds = append(conds, "canceled_at IS NULL")
+	case "canceled":
+		conds = append(conds, "canceled_at IS NOT NULL")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// saleReportColumns shapes the reservations for reports: the sale is to
+// the user who bought the sheet, whoever owns it now.
+const saleReportColumns = "id, event_id, sheet_id, original_user_id AS user_id, reserved_at, canceled_at, price, updated_at, discount, promo_code_id, NULL AS seller_id"
+
+// resaleReportColumns shapes the sold resale listings like reservations:
+// the buyer bought the sheet from the seller for the listing price when it
+// was sold.
+const resaleReportColumns = "r.id, r.event_id, r.sheet_id, l.buyer_id AS user_id, l.sold_at AS reserved_at, NULL AS canceled_at, l.price, l.sold_at AS updated_at, 0 AS discount, NULL AS promo_code_id, l.seller_id"
+
+// queryReports selects the row type, reservationColumns and seller_id of
+// the sales and resales of a report in sold order.
+func queryReports(f *ReportFilter) (*sql.Rows, error) {
+	where, args := f.where()
+	return db.Query("SELECT '"+reportSale+"', "+reservationColumns+", seller_id FROM (SELECT "+saleReportColumns+" FROM reservations) sales WHERE "+where+
+		" UNION ALL SELECT '"+reportResale+"', "+reservationColumns+", seller_id FROM (SELECT "+resaleReportColumns+
+		" FROM resale_listings l JOIN reservations r ON r.id = l.reservation_id WHERE l.sold_at IS NOT NULL) resales WHERE "+where+
+		" ORDER BY reserved_at ASC, id ASC", append(args, args...)...)
+}
+
+var reportHeader = []string{"reservation_id", "event_id", "rank", "num", "price", "user_id", "sold_at", "canceled_at", "discount", "promo_code", "type", "seller_id"}
+
+// reportNumeric marks the columns of reportHeader holding numbers.
+var reportNumeric = []bool{true, true, false, true, true, true, false, false, true, false, false, true}
+
+func newReport(reservation *Reservation, kind string) Report {
+	sheet := getSheet(reservation.SheetID)
+	report := Report{
+		ReservationID: reservation.ID,
+		EventID:       reservation.EventID,
+		Rank:          sheet.Rank,
+		Num:           sheet.Num,
+		UserID:        reservation.UserID,
+		SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
+		Price:         reservation.Price,
+		Discount:      reservation.Discount,
+		Type:          kind,
+	}
+	if reservation.PromoCodeID != nil {
+		report.PromoCode = promoCodeName(*reservation.PromoCodeID)
+	}
+	if reservation.CanceledAt != nil {
+		report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
+	}
+	return report
+}
+
+func (r *Report) record(record []string) []string {
+	return append(record[:0],
+		strconv.FormatInt(r.ReservationID, 10),
+		strconv.FormatInt(r.EventID, 10),
+		r.Rank,
+		strconv.FormatInt(r.Num, 10),
+		strconv.FormatInt(r.Price, 10),
+		strconv.FormatInt(r.UserID, 10),
+		r.SoldAt,
+		r.CanceledAt,
+		strconv.FormatInt(r.Discount, 10),
+		r.PromoCode,
+		r.Type,
+		formatIDOrEmpty(r.SellerID),
+	)
+}
+
+// formatIDOrEmpty formats an optional id, leaving 0 empty.
+func formatIDOrEmpty(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// beginReport starts a report response in format and returns the writer
+// for its rows.
+func beginReport(c echo.Context, format *reportFormat) (ReportWriter, error) {
+	res := c.Response()
+	res.Header().Set("Content-Type", format.contentType)
+	res.Header().Set("Content-Disposition", `attachment; filename="report.`+format.ext+`"`)
+	res.WriteHeader(200)
+
+	w := format.newWriter(res)
+	if err := w.Begin(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// renderReport writes each reservation of rows to the response as soon as
+// it is read, so a report never has to fit in memory. rows must select
+// the row type, reservationColumns and the seller id in the order the
+// report should have.
+func renderReport(c echo.Context, format *reportFormat, rows *sql.Rows) error {
+	w, err := beginReport(c, format)
+	if err != nil {
+		return err
+	}
+	// Every column is scanned on each row, so the destinations are reused.
+	var kind string
+	var reservation Reservation
+	var sellerID sql.NullInt64
+	dest := append(append([]interface{}{&kind}, reservation.columns()...), &sellerID)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		report := newReport(&reservation, kind)
+		report.SellerID = sellerID.Int64
+		if err := w.Write(&report); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.End()
+}
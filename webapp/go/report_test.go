@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// reportRowsDriver serves "SELECT <n>" with n generated report rows shaped
+// like queryReports, so reports can be rendered without a database.
+type reportRowsDriver struct{}
+
+func (reportRowsDriver) Open(string) (driver.Conn, error) { return reportRowsConn{}, nil }
+
+type reportRowsConn struct{}
+
+func (reportRowsConn) Prepare(query string) (driver.Stmt, error) {
+	n, err := strconv.Atoi(query[len("SELECT "):])
+	return reportRowsStmt(n), err
+}
+func (reportRowsConn) Close() error              { return nil }
+func (reportRowsConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type reportRowsStmt int
+
+func (reportRowsStmt) Close() error  { return nil }
+func (reportRowsStmt) NumInput() int { return -1 }
+func (reportRowsStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (s reportRowsStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &reportRows{n: int(s)}, nil
+}
+
+type reportRows struct {
+	n, i int
+}
+
+func (*reportRows) Columns() []string {
+	return []string{"type", "id", "event_id", "sheet_id", "user_id", "reserved_at", "canceled_at", "price", "updated_at", "discount", "promo_code_id", "seller_id"}
+}
+func (*reportRows) Close() error { return nil }
+
+var reportRowsTime = time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)
+
+func (r *reportRows) Next(dest []driver.Value) error {
+	if r.i == r.n {
+		return io.EOF
+	}
+	r.i++
+	at := reportRowsTime.Add(time.Duration(r.i) * time.Second)
+	var canceledAt driver.Value
+	if r.i%4 == 0 {
+		canceledAt = at.Add(time.Hour)
+	}
+	dest[0], dest[1], dest[2], dest[3], dest[4] = reportSale, int64(r.i), int64(1), int64(r.i%1000+1), int64(r.i%500+1)
+	dest[5], dest[6], dest[7], dest[8], dest[9], dest[10] = at, canceledAt, int64(3000+r.i%5000), at, int64(0), nil
+	dest[11] = nil
+	return nil
+}
+
+func init() {
+	sql.Register("reportrows", reportRowsDriver{})
+}
+
+// discardResponseWriter drops the response body so that the benchmark
+// measures what the server holds, not a buffered response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+// heapSamplingWriter measures the live heap each time the report writes to
+// the response, which the CSV writer does every few rows, and keeps the
+// peak. The body is dropped unless body is set to buffer the response.
+type heapSamplingWriter struct {
+	discardResponseWriter
+	body *bytes.Buffer
+	peak uint64
+}
+
+func (w *heapSamplingWriter) Write(b []byte) (int, error) {
+	if w.body != nil {
+		w.body.Write(b)
+	}
+	// Collect first so that only what the report still holds is counted.
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > w.peak {
+		w.peak = m.HeapAlloc
+	}
+	return len(b), nil
+}
+
+func renderTestReport(b *testing.B, conn *sql.DB, rows int, w http.ResponseWriter) {
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest("GET", "/admin/api/reports/sales", nil), w)
+	result, err := conn.Query("SELECT " + strconv.Itoa(rows))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer result.Close()
+	if err := renderReport(c, reportFormats[0], result); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkRenderReportCSV streams reports of 1000 and 10000 rows. The
+// allocations and bytes per row stay flat as the report grows, since rows
+// are written as they are read.
+func BenchmarkRenderReportCSV(b *testing.B) {
+	conn, err := sql.Open("reportrows", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, rows := range []int{1000, 10000} {
+		b.Run(strconv.Itoa(rows)+"rows", func(b *testing.B) {
+			b.ReportAllocs()
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				renderTestReport(b, conn, rows, &discardResponseWriter{header: http.Header{}})
+			}
+			runtime.ReadMemStats(&after)
+			total := float64(b.N * rows)
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/total, "allocs/row")
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/total, "B/row")
+		})
+	}
+}
+
+// BenchmarkRenderReportCSVHeap reports peak-heap-B, the most live heap
+// above the idle heap while a report of 1000 or 10000 rows is written. A
+// streamed report stays flat as it grows; the buffered baseline grows with
+// the report. The heap is collected at every sample, so ns/op is not
+// meaningful here.
+func BenchmarkRenderReportCSVHeap(b *testing.B) {
+	conn, err := sql.Open("reportrows", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, mode := range []string{"streamed", "buffered"} {
+		for _, rows := range []int{1000, 10000} {
+			b.Run(mode+"/"+strconv.Itoa(rows)+"rows", func(b *testing.B) {
+				var peak uint64
+				for i := 0; i < b.N; i++ {
+					var idle runtime.MemStats
+					runtime.GC()
+					runtime.ReadMemStats(&idle)
+					w := &heapSamplingWriter{discardResponseWriter: discardResponseWriter{header: http.Header{}}}
+					if mode == "buffered" {
+						w.body = &bytes.Buffer{}
+					}
+
+					renderTestReport(b, conn, rows, w)
+					if w.peak > idle.HeapAlloc && w.peak-idle.HeapAlloc > peak {
+						peak = w.peak - idle.HeapAlloc
+					}
+				}
+				b.ReportMetric(float64(peak), "peak-heap-B")
+			})
+		}
+	}
+}
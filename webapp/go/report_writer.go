@@ -0,0 +1,242 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReportWriter encodes a stream of reports. Begin is called once before
+// the first Write and End once after the last one.
+type ReportWriter interface {
+	Begin() error
+	Write(r *Report) error
+	End() error
+}
+
+type reportFormat struct {
+	name        string
+	contentType string
+	ext         string
+	newWriter   func(w io.Writer) ReportWriter
+}
+
+var reportFormats = []*reportFormat{
+	{"csv", "text/csv; charset=UTF-8", "csv", newCSVReportWriter},
+	{"json", "application/json; charset=UTF-8", "json", newJSONReportWriter},
+	{"ndjson", "application/x-ndjson", "ndjson", newNDJSONReportWriter},
+	{"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx", newXLSXReportWriter},
+}
+
+// negotiateReportFormat picks the format named by the format query
+// parameter, or else the first one acceptable in the Accept header. CSV is
+// the default. nil is returned for an unknown format parameter.
+func negotiateReportFormat(c echo.Context) *reportFormat {
+	if name := c.QueryParam("format"); name != "" {
+		for _, f := range reportFormats {
+			if f.name == name {
+				return f
+			}
+		}
+		return nil
+	}
+
+	for _, accept := range strings.Split(c.Request().Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/ndjson" {
+			mediaType = "application/x-ndjson"
+		}
+		for _, f := range reportFormats {
+			if t, _, _ := mime.ParseMediaType(f.contentType); t == mediaType {
+				return f
+			}
+		}
+	}
+	return reportFormats[0]
+}
+
+type csvReportWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVReportWriter(w io.Writer) ReportWriter {
+	return &csvReportWriter{w: csv.NewWriter(w), record: make([]string, 0, len(reportHeader))}
+}
+
+func (w *csvReportWriter) Begin() error {
+	return w.w.Write(reportHeader)
+}
+
+func (w *csvReportWriter) Write(r *Report) error {
+	w.record = r.record(w.record)
+	return w.w.Write(w.record)
+}
+
+func (w *csvReportWriter) End() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// jsonReportWriter writes a single JSON array, one element per line.
+type jsonReportWriter struct {
+	w     *bufio.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONReportWriter(w io.Writer) ReportWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonReportWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (w *jsonReportWriter) Begin() error {
+	_, err := w.w.WriteString("[\n")
+	return err
+}
+
+func (w *jsonReportWriter) Write(r *Report) error {
+	if w.count > 0 {
+		if _, err := w.w.WriteString(","); err != nil {
+			return err
+		}
+	}
+	w.count++
+	return w.enc.Encode(r)
+}
+
+func (w *jsonReportWriter) End() error {
+	if _, err := w.w.WriteString("]\n"); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+type ndjsonReportWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONReportWriter(w io.Writer) ReportWriter {
+	bw := bufio.NewWriter(w)
+	return &ndjsonReportWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (w *ndjsonReportWriter) Begin() error { return nil }
+
+func (w *ndjsonReportWriter) Write(r *Report) error {
+	return w.enc.Encode(r)
+}
+
+func (w *ndjsonReportWriter) End() error {
+	return w.w.Flush()
+}
+
+// xlsxReportWriter writes a workbook with a single worksheet. The zip
+// archive is written without seeking, so the worksheet can be streamed
+// into it row by row; strings are stored inline rather than in a shared
+// string table for the same reason.
+type xlsxReportWriter struct {
+	zw     *zip.Writer
+	sheet  *bufio.Writer
+	record []string
+	row    int
+}
+
+func newXLSXReportWriter(w io.Writer) ReportWriter {
+	return &xlsxReportWriter{zw: zip.NewWriter(w), record: make([]string, 0, len(reportHeader))}
+}
+
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="sales" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func (w *xlsxReportWriter) Begin() error {
+	for _, part := range xlsxParts {
+		f, err := w.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+
+	f, err := w.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	w.sheet = bufio.NewWriter(f)
+	w.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return w.writeRow(reportHeader, nil)
+}
+
+func (w *xlsxReportWriter) Write(r *Report) error {
+	w.record = r.record(w.record)
+	return w.writeRow(w.record, reportNumeric)
+}
+
+func (w *xlsxReportWriter) writeRow(record []string, numeric []bool) error {
+	w.row++
+	row := strconv.Itoa(w.row)
+	w.sheet.WriteString(`<row r="` + row + `">`)
+	for i, v := range record {
+		if v == "" {
+			continue
+		}
+		ref := xlsxColumn(i) + row
+		if numeric != nil && numeric[i] {
+			w.sheet.WriteString(`<c r="` + ref + `"><v>` + v + `</v></c>`)
+			continue
+		}
+		w.sheet.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t>`)
+		if err := xml.EscapeText(w.sheet, []byte(v)); err != nil {
+			return err
+		}
+		w.sheet.WriteString(`</t></is></c>`)
+	}
+	_, err := w.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (w *xlsxReportWriter) End() error {
+	w.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.zw.Close()
+}
+
+// xlsxColumn returns the column letters of the zero based index i.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ResaleListing offers a reservation for sale to other users. Its price
+// may not exceed the face value of the reservation, the price it was sold
+// for before any promo code discount.
+type ResaleListing struct {
+	ID            int64      `json:"id"`
+	ReservationID int64      `json:"-"`
+	EventID       int64      `json:"event_id"`
+	SheetRank     string     `json:"sheet_rank"`
+	SheetNum      int64      `json:"sheet_num"`
+	Price         int64      `json:"price"`
+	SellerID      int64      `json:"-"`
+	CreatedAt     *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+// openResaleCondition matches the listings of l that can still be bought:
+// neither sold nor withdrawn, on an active reservation the seller owns.
+const openResaleCondition = "l.sold_at IS NULL AND l.canceled_at IS NULL AND r.canceled_at IS NULL AND r.user_id = l.seller_id"
+
+func addResaleHandler(c echo.Context) error {
+	var params struct {
+		Price int64 `json:"price"`
+	}
+	c.Bind(&params)
+
+	user, event, sheet, err := findOwnedSheet(c)
+	if event == nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	reservation, err := lockOwnedReservation(tx, event, sheet, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return resOwnedReservationError(c, err)
+	}
+
+	if params.Price <= 0 || params.Price > reservation.Price+reservation.Discount {
+		tx.Rollback()
+		return resError(c, "invalid_price", 400)
+	}
+
+	var listed int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM resale_listings WHERE reservation_id = ? AND seller_id = ? AND sold_at IS NULL AND canceled_at IS NULL", reservation.ID, user.ID).Scan(&listed); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if listed > 0 {
+		tx.Rollback()
+		return resError(c, "duplicated", 409)
+	}
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO resale_listings (reservation_id, seller_id, price, created_at) VALUES (?, ?, ?, ?)",
+		reservation.ID, user.ID, params.Price, now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	listingID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return c.JSON(201, ResaleListing{
+		ID:            listingID,
+		ReservationID: reservation.ID,
+		EventID:       event.ID,
+		SheetRank:     sheet.Rank,
+		SheetNum:      sheet.Num,
+		Price:         params.Price,
+		SellerID:      user.ID,
+		CreatedAt:     &now,
+		CreatedAtUnix: now.Unix(),
+	})
+}
+
+// getResalesHandler lists the open resale listings of an event, cheapest
+// first.
+func getResalesHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	rows, err := db.Query("SELECT l.id, l.reservation_id, r.event_id, r.sheet_id, l.price, l.seller_id, l.created_at "+
+		"FROM resale_listings l JOIN reservations r ON r.id = l.reservation_id "+
+		"WHERE r.event_id = ? AND "+openResaleCondition+" ORDER BY l.price ASC, l.id ASC", eventID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	listings := make([]ResaleListing, 0)
+	for rows.Next() {
+		var listing ResaleListing
+		var sheetID int64
+		if err := rows.Scan(&listing.ID, &listing.ReservationID, &listing.EventID, &sheetID, &listing.Price, &listing.SellerID, &listing.CreatedAt); err != nil {
+			return err
+		}
+		sheet := getSheet(sheetID)
+		listing.SheetRank = sheet.Rank
+		listing.SheetNum = sheet.Num
+		listing.CreatedAtUnix = listing.CreatedAt.Unix()
+		listings = append(listings, listing)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, listings)
+}
+
+// buyResaleHandler moves the reservation of a listing to the buyer and
+// marks the listing sold in one transaction.
+func buyResaleHandler(c echo.Context) error {
+	listingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "listing_not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var reservationID, sellerID, price int64
+	var soldAt, canceledAt *time.Time
+	if err := tx.QueryRow("SELECT reservation_id, seller_id, price, sold_at, canceled_at FROM resale_listings WHERE id = ? FOR UPDATE", listingID).
+		Scan(&reservationID, &sellerID, &price, &soldAt, &canceledAt); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "listing_not_found", 404)
+		}
+		return err
+	}
+	if soldAt != nil || canceledAt != nil {
+		tx.Rollback()
+		return resError(c, "listing_not_found", 404)
+	}
+	if sellerID == user.ID {
+		tx.Rollback()
+		return resError(c, "not_permitted", 403)
+	}
+
+	var reservation Reservation
+	if err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE id = ? FOR UPDATE", reservationID), &reservation); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if reservation.CanceledAt != nil || reservation.UserID != sellerID {
+		tx.Rollback()
+		return resError(c, "listing_not_found", 404)
+	}
+
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", reservation.EventID), &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !event.visible() {
+		tx.Rollback()
+		return resError(c, "invalid_event", 404)
+	}
+	if err := event.checkCancelable(time.Now()); err != nil {
+		tx.Rollback()
+		return resError(c, "event_started", 403)
+	}
+
+	sheet := getSheet(reservation.SheetID)
+	if err := checkPurchaseLimits(tx, &event, user.ID, []*Sheet{&sheet}); err != nil {
+		tx.Rollback()
+		if err == errLimitExceeded {
+			return resError(c, "limit_exceeded", 409)
+		}
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE resale_listings SET buyer_id = ?, sold_at = ? WHERE id = ?", user.ID, now.Format("2006-01-02 15:04:05.000000"), listingID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := changeReservationOwner(tx, reservation.ID, user.ID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return c.JSON(202, echo.Map{
+		"id":         reservation.ID,
+		"event_id":   reservation.EventID,
+		"sheet_rank": sheet.Rank,
+		"sheet_num":  sheet.Num,
+		"price":      price,
+	})
+}
+
+func removeResaleHandler(c echo.Context) error {
+	listingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "listing_not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("UPDATE resale_listings SET canceled_at = ? WHERE id = ? AND seller_id = ? AND sold_at IS NULL AND canceled_at IS NULL",
+		time.Now().UTC().Format("2006-01-02 15:04:05.000000"), listingID, user.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "listing_not_found", 404)
+	}
+	return c.NoContent(204)
+}
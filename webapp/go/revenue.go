@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Revenue aggregates reservations.price over one group of a revenue
+// report. Gross counts every sale including the ones canceled later,
+// Refunds the canceled ones. SellThrough is the share of the group's
+// sheets that are sold and not canceled; it is left out for time periods.
+type Revenue struct {
+	EventID int64  `json:"event_id,omitempty"`
+	Rank    string `json:"rank,omitempty"`
+	Period  string `json:"period,omitempty"`
+
+	Sold        int64    `json:"sold"`
+	Canceled    int64    `json:"canceled"`
+	Gross       int64    `json:"gross"`
+	Refunds     int64    `json:"refunds"`
+	Net         int64    `json:"net"`
+	Sheets      int64    `json:"sheets,omitempty"`
+	SellThrough *float64 `json:"sell_through,omitempty"`
+}
+
+// revenuePeriods maps the time based group_by values to the DATE_FORMAT
+// pattern of their period labels.
+var revenuePeriods = map[string]string{
+	"day":  "%Y-%m-%d",
+	"hour": "%Y-%m-%dT%H:00",
+}
+
+func (r *Revenue) finish(sheets int64) {
+	r.Net = r.Gross - r.Refunds
+	if sheets > 0 {
+		r.Sheets = sheets
+		rate := float64(r.Sold-r.Canceled) / float64(sheets)
+		r.SellThrough = &rate
+	}
+}
+
+// revenueSheets returns the number of sheets on sale in the events matched
+// by filter, in total and per event and per rank.
+func revenueSheets(f *ReportFilter) (total int64, byEvent map[int64]int64, byRank map[string]int64, err error) {
+	query := "SELECT id, venue_id FROM events"
+	var args []interface{}
+	if f.EventID != 0 {
+		query += " WHERE id = ?"
+		args = append(args, f.EventID)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer rows.Close()
+
+	byEvent = map[int64]int64{}
+	byRank = map[string]int64{}
+	for rows.Next() {
+		var eventID, venueID int64
+		if err := rows.Scan(&eventID, &venueID); err != nil {
+			return 0, nil, nil, err
+		}
+		venue, ok := getVenue(venueID)
+		if !ok {
+			continue
+		}
+		for _, rank := range venue.Ranks {
+			if f.Rank != "" && rank.Rank != f.Rank {
+				continue
+			}
+			total += int64(rank.Total)
+			byEvent[eventID] += int64(rank.Total)
+			byRank[rank.Rank] += int64(rank.Total)
+		}
+	}
+	return total, byEvent, byRank, rows.Err()
+}
+
+// revenueSales is the reservations as sold, shaped like the sale rows of
+// reports so that the user_id filter matches the buyer, not the current
+// owner of a transferred or resold sheet.
+const revenueSales = "(SELECT " + saleReportColumns + " FROM reservations)"
+
+// getRevenue aggregates the reservations matched by filter by event, rank,
+// day or hour. Sales fall into the period they were made in and refunds
+// into the period they were canceled in.
+func getRevenue(f *ReportFilter, groupBy string) ([]*Revenue, *Revenue, error) {
+	total, byEvent, byRank, err := revenueSheets(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	where, args := f.where()
+	var rows *sql.Rows
+	if layout, ok := revenuePeriods[groupBy]; ok {
+		rows, err = db.Query("SELECT period, SUM(sold), SUM(canceled), SUM(gross), SUM(refunds) FROM ("+
+			"SELECT DATE_FORMAT(reserved_at, '"+layout+"') AS period, 1 AS sold, 0 AS canceled, price AS gross, 0 AS refunds FROM "+revenueSales+" sales WHERE "+where+
+			" UNION ALL "+
+			"SELECT DATE_FORMAT(canceled_at, '"+layout+"'), 0, 1, 0, price FROM "+revenueSales+" sales WHERE canceled_at IS NOT NULL AND "+where+
+			") t GROUP BY period ORDER BY period ASC", append(args, args...)...)
+	} else {
+		column := "r.event_id"
+		if groupBy == "rank" {
+			column = "s.`rank`"
+		}
+		rows, err = db.Query("SELECT "+column+", COUNT(*), COUNT(r.canceled_at), SUM(r.price), SUM(IF(r.canceled_at IS NULL, 0, r.price)) "+
+			"FROM "+revenueSales+" r JOIN sheets s ON s.id = r.sheet_id WHERE "+where+" GROUP BY "+column+" ORDER BY "+column+" ASC", args...)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Revenue, 0)
+	sum := &Revenue{}
+	for rows.Next() {
+		var key string
+		r := &Revenue{}
+		if err := rows.Scan(&key, &r.Sold, &r.Canceled, &r.Gross, &r.Refunds); err != nil {
+			return nil, nil, err
+		}
+		switch groupBy {
+		case "event":
+			r.EventID, _ = strconv.ParseInt(key, 10, 64)
+			r.finish(byEvent[r.EventID])
+		case "rank":
+			r.Rank = key
+			r.finish(byRank[r.Rank])
+		default:
+			r.Period = key
+			r.finish(0)
+		}
+		sum.Sold += r.Sold
+		sum.Canceled += r.Canceled
+		sum.Gross += r.Gross
+		sum.Refunds += r.Refunds
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	sum.finish(total)
+	return list, sum, nil
+}
+
+func renderRevenue(c echo.Context, filter *ReportFilter, groupBy string) error {
+	switch groupBy {
+	case "event", "rank", "day", "hour":
+	default:
+		return resError(c, "invalid_group_by", 400)
+	}
+
+	list, total, err := getRevenue(filter, groupBy)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, echo.Map{
+		"group_by": groupBy,
+		"rows":     list,
+		"total":    total,
+	})
+}
+
+func getRevenueHandler(c echo.Context) error {
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		return resError(c, "invalid_filter", 400)
+	}
+	if v := c.QueryParam("event_id"); v != "" {
+		if filter.EventID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return resError(c, "invalid_filter", 400)
+		}
+	}
+
+	groupBy := c.QueryParam("group_by")
+	if groupBy == "" {
+		groupBy = "event"
+	}
+	return renderRevenue(c, filter, groupBy)
+}
+
+func getEventRevenueHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		return resError(c, "invalid_filter", 400)
+	}
+	filter.EventID = eventID
+
+	groupBy := c.QueryParam("group_by")
+	if groupBy == "" {
+		groupBy = "rank"
+	}
+	return renderRevenue(c, filter, groupBy)
+}
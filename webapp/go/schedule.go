@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errSalesNotOpen = errors.New("event: sales not open yet")
+	errSalesClosed  = errors.New("event: sales closed")
+	errEventStarted = errors.New("event: already started")
+)
+
+// fillSchedule sets the venue label and the unix timestamps rendered in
+// JSON from the scanned schedule columns.
+func (e *Event) fillSchedule() {
+	if venue, ok := getVenue(e.VenueID); ok {
+		e.Venue = venue.Name
+	}
+	e.StartAtUnix = unixOrZero(e.StartAt)
+	e.SalesOpenAtUnix = unixOrZero(e.SalesOpenAt)
+	e.SalesCloseAtUnix = unixOrZero(e.SalesCloseAt)
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+// timeFromUnix is the inverse of unixOrZero for request parameters.
+func timeFromUnix(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// checkSalesWindow reports whether sheets of the event can be sold at now.
+// An unset bound leaves that side of the window open.
+func (e *Event) checkSalesWindow(now time.Time) error {
+	if e.SalesOpenAt != nil && now.Before(*e.SalesOpenAt) {
+		return errSalesNotOpen
+	}
+	if e.SalesCloseAt != nil && !now.Before(*e.SalesCloseAt) {
+		return errSalesClosed
+	}
+	if e.StartAt != nil && !now.Before(*e.StartAt) {
+		return errSalesClosed
+	}
+	return nil
+}
+
+func resSalesWindowError(c echo.Context, err error) error {
+	if err == errSalesPaused {
+		return resError(c, "sales_paused", 403)
+	}
+	if err == errSalesNotOpen {
+		return resError(c, "sales_not_open", 403)
+	}
+	return resError(c, "sales_closed", 403)
+}
+
+// checkCancelable reports whether reservations of the event can still be
+// canceled at now, which is until the event starts.
+func (e *Event) checkCancelable(now time.Time) error {
+	if e.StartAt != nil && !now.Before(*e.StartAt) {
+		return errEventStarted
+	}
+	return nil
+}
+
+// validSchedule reports whether the sales window opens before it closes
+// and closes no later than the event starts.
+func validSchedule(startAt, salesOpenAt, salesCloseAt *time.Time) bool {
+	if salesOpenAt != nil && salesCloseAt != nil && !salesOpenAt.Before(*salesCloseAt) {
+		return false
+	}
+	if salesCloseAt != nil && startAt != nil && salesCloseAt.After(*startAt) {
+		return false
+	}
+	if salesOpenAt != nil && startAt != nil && !salesOpenAt.Before(*startAt) {
+		return false
+	}
+	return true
+}
+
+// nullTime formats t for a DATETIME(6) column, or NULL.
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
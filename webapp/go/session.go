@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+// sessionConfig is read from the environment:
+//
+//	SESSION_SECRETS   required; comma separated signing keys, newest first; older keys
+//	                  are only used to verify cookies during rotation. Keep them
+//	                  out of the repository; `make secrets` generates webapp/secrets.env
+//	SESSION_MAX_AGE   lifetime in seconds (default 3600)
+//	SESSION_SECURE    send the cookie over HTTPS only
+//	SESSION_SAMESITE  lax, strict, none or default
+//	SESSION_STORE     cookie (default), memory or mysql
+type sessionConfig struct {
+	Secrets  [][]byte
+	MaxAge   int
+	Secure   bool
+	SameSite http.SameSite
+	Store    string
+}
+
+var sessionConf sessionConfig
+
+func loadSessionConfig() (sessionConfig, error) {
+	conf := sessionConfig{
+		MaxAge:   3600,
+		SameSite: http.SameSiteDefaultMode,
+		Store:    "cookie",
+	}
+
+	for _, secret := range strings.Split(os.Getenv("SESSION_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			conf.Secrets = append(conf.Secrets, []byte(secret))
+		}
+	}
+	if len(conf.Secrets) == 0 {
+		return conf, errors.New("SESSION_SECRETS is not set")
+	}
+
+	if v := os.Getenv("SESSION_MAX_AGE"); v != "" {
+		maxAge, err := strconv.Atoi(v)
+		if err != nil || maxAge <= 0 {
+			return conf, fmt.Errorf("invalid SESSION_MAX_AGE %q", v)
+		}
+		conf.MaxAge = maxAge
+	}
+
+	if v := os.Getenv("SESSION_SECURE"); v != "" {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return conf, fmt.Errorf("invalid SESSION_SECURE %q", v)
+		}
+		conf.Secure = secure
+	}
+
+	switch v := strings.ToLower(os.Getenv("SESSION_SAMESITE")); v {
+	case "", "default":
+	case "lax":
+		conf.SameSite = http.SameSiteLaxMode
+	case "strict":
+		conf.SameSite = http.SameSiteStrictMode
+	case "none":
+		conf.SameSite = http.SameSiteNoneMode
+	default:
+		return conf, fmt.Errorf("invalid SESSION_SAMESITE %q", v)
+	}
+
+	if v := os.Getenv("SESSION_STORE"); v != "" {
+		conf.Store = v
+	}
+	return conf, nil
+}
+
+func sessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionConf.MaxAge,
+		HttpOnly: true,
+		Secure:   sessionConf.Secure,
+		SameSite: sessionConf.SameSite,
+	}
+}
+
+// sessionCodecs signs cookies with the first secret and accepts any of them.
+func sessionCodecs() []securecookie.Codec {
+	pairs := make([][]byte, 0, len(sessionConf.Secrets)*2)
+	for _, secret := range sessionConf.Secrets {
+		pairs = append(pairs, secret, nil)
+	}
+	codecs := securecookie.CodecsFromPairs(pairs...)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(sessionConf.MaxAge)
+		}
+	}
+	return codecs
+}
+
+func newSessionStore() (sessions.Store, error) {
+	switch sessionConf.Store {
+	case "cookie":
+		return &sessions.CookieStore{Codecs: sessionCodecs(), Options: sessionOptions()}, nil
+	case "memory":
+		return &ServerSessionStore{Codecs: sessionCodecs(), Options: sessionOptions(), backend: newMemorySessionBackend()}, nil
+	case "mysql":
+		return &ServerSessionStore{Codecs: sessionCodecs(), Options: sessionOptions(), backend: mysqlSessionBackend{}}, nil
+	}
+	return nil, fmt.Errorf("unknown SESSION_STORE %q", sessionConf.Store)
+}
+
+var sessionStore sessions.Store
+
+var errSessionNotFound = errors.New("session: not found")
+
+// sessionBackend persists server-side sessions. userID is the logged in
+// user of the session, or 0, so that all sessions of a user can be revoked.
+type sessionBackend interface {
+	load(id string) ([]byte, error)
+	save(id string, userID int64, data []byte, expiresAt time.Time) error
+	delete(id string) error
+	deleteUser(userID int64) error
+	deleteExpired(now time.Time) error
+}
+
+// ServerSessionStore keeps session values on the server and only puts a
+// signed session id in the cookie, so sessions can be revoked.
+type ServerSessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	backend sessionBackend
+}
+
+func (s *ServerSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *ServerSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	data, err := s.backend.load(session.ID)
+	if err != nil {
+		session.ID = ""
+		if err == errSessionNotFound {
+			return session, nil
+		}
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *ServerSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(id), "=")
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	userID, _ := session.Values["user_id"].(int64)
+	expiresAt := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if err := s.backend.save(session.ID, userID, data, expiresAt); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// RevokeUser deletes every session the user is logged in with.
+func (s *ServerSessionStore) RevokeUser(userID int64) error {
+	return s.backend.deleteUser(userID)
+}
+
+// Sweep deletes expired sessions every interval, since a session that is
+// never sent again is otherwise never looked up and deleted. It never
+// returns and is meant to run in its own goroutine.
+func (s *ServerSessionStore) Sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := s.backend.deleteExpired(now); err != nil {
+			log.Println("sweep sessions:", err)
+		}
+	}
+}
+
+type memorySession struct {
+	userID    int64
+	data      []byte
+	expiresAt time.Time
+}
+
+type memorySessionBackend struct {
+	mu       sync.Mutex
+	sessions map[string]memorySession
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: map[string]memorySession{}}
+}
+
+func (b *memorySessionBackend) load(id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	if time.Now().After(s.expiresAt) {
+		delete(b.sessions, id)
+		return nil, errSessionNotFound
+	}
+	return s.data, nil
+}
+
+func (b *memorySessionBackend) save(id string, userID int64, data []byte, expiresAt time.Time) error {
+	b.mu.Lock()
+	b.sessions[id] = memorySession{userID: userID, data: data, expiresAt: expiresAt}
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memorySessionBackend) delete(id string) error {
+	b.mu.Lock()
+	delete(b.sessions, id)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memorySessionBackend) deleteUser(userID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, s := range b.sessions {
+		if s.userID == userID {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) deleteExpired(now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, s := range b.sessions {
+		if now.After(s.expiresAt) {
+			delete(b.sessions, id)
+		}
+	}
+	return nil
+}
+
+type mysqlSessionBackend struct{}
+
+func (mysqlSessionBackend) load(id string) ([]byte, error) {
+	var data []byte
+	if err := db.QueryRow("SELECT data FROM sessions WHERE id = ? AND expires_at > ?", id, time.Now().UTC().Format("2006-01-02 15:04:05")).Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errSessionNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (mysqlSessionBackend) save(id string, userID int64, data []byte, expiresAt time.Time) error {
+	_, err := db.Exec("INSERT INTO sessions (id, user_id, data, expires_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), data = VALUES(data), expires_at = VALUES(expires_at)",
+		id, userID, data, expiresAt.UTC().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func (mysqlSessionBackend) delete(id string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+func (mysqlSessionBackend) deleteUser(userID int64) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+func (mysqlSessionBackend) deleteExpired(now time.Time) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE expires_at <= ?", now.UTC().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func revokeAdminUserSessionsHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	store, ok := sessionStore.(*ServerSessionStore)
+	if !ok {
+		return resError(c, "revocation_unsupported", 400)
+	}
+
+	var id int64
+	if err := db.QueryRow("SELECT id FROM users WHERE id = ?", userID).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		return err
+	}
+
+	if err := store.RevokeUser(id); err != nil {
+		return err
+	}
+	return c.NoContent(204)
+}
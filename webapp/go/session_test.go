@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionBackendDeleteExpired(t *testing.T) {
+	b := newMemorySessionBackend()
+	now := time.Now()
+	b.save("old", 1, []byte("a"), now.Add(-time.Second))
+	b.save("new", 1, []byte("b"), now.Add(time.Hour))
+
+	if err := b.deleteExpired(now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.sessions["old"]; ok {
+		t.Error("expired session was kept")
+	}
+	if _, ok := b.sessions["new"]; !ok {
+		t.Error("live session was deleted")
+	}
+}
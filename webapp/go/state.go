@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Event states. public_fg and closed_fg are kept in sync with the state
+// for older readers of the events table.
+const (
+	StateDraft    = "draft"
+	StateOnSale   = "on_sale"
+	StatePaused   = "paused"
+	StateSoldOut  = "sold_out"
+	StateClosed   = "closed"
+	StateCanceled = "canceled"
+)
+
+// eventTransitions lists the states each state may move to. Closed and
+// canceled events are final.
+var eventTransitions = map[string][]string{
+	StateDraft:    {StateOnSale, StateClosed, StateCanceled},
+	StateOnSale:   {StateDraft, StatePaused, StateSoldOut, StateCanceled},
+	StatePaused:   {StateDraft, StateOnSale, StateClosed, StateCanceled},
+	StateSoldOut:  {StateDraft, StateOnSale, StatePaused, StateCanceled},
+	StateClosed:   {},
+	StateCanceled: {},
+}
+
+var (
+	errInvalidTransition = errors.New("event: invalid state transition")
+	errSalesPaused       = errors.New("event: sales paused")
+	errEventHidden       = errors.New("event: not visible")
+)
+
+func canTransition(from, to string) bool {
+	for _, s := range eventTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether the event is shown to users.
+func (e *Event) visible() bool {
+	return e.State == StateOnSale || e.State == StatePaused || e.State == StateSoldOut
+}
+
+// final reports whether the event can no longer be edited.
+func (e *Event) final() bool {
+	return e.State == StateClosed || e.State == StateCanceled
+}
+
+// checkSelling reports whether sheets of the event can be sold at now,
+// considering both its state and its sales window.
+func (e *Event) checkSelling(now time.Time) error {
+	if e.State == StatePaused {
+		return errSalesPaused
+	}
+	return e.checkSalesWindow(now)
+}
+
+// EventTransition records a change of an event's state. AdministratorID is
+// 0 for automatic transitions such as selling out.
+type EventTransition struct {
+	ID              int64      `json:"id"`
+	EventID         int64      `json:"event_id"`
+	FromState       string     `json:"from"`
+	ToState         string     `json:"to"`
+	AdministratorID int64      `json:"administrator_id,omitempty"`
+	CreatedAt       *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+// transitionEvent moves the event locked in tx to another state and
+// records the transition.
+func transitionEvent(tx *sql.Tx, event *Event, to string, administratorID int64) error {
+	if !canTransition(event.State, to) {
+		return errInvalidTransition
+	}
+
+	public := to == StateOnSale || to == StatePaused || to == StateSoldOut
+	closed := to == StateClosed || to == StateCanceled
+	if _, err := tx.Exec("UPDATE events SET state = ?, public_fg = ?, closed_fg = ? WHERE id = ?", to, public, closed, event.ID); err != nil {
+		return err
+	}
+
+	var adminID interface{}
+	if administratorID != 0 {
+		adminID = administratorID
+	}
+	if _, err := tx.Exec("INSERT INTO event_transitions (event_id, from_state, to_state, administrator_id, created_at) VALUES (?, ?, ?, ?, ?)",
+		event.ID, event.State, to, adminID, time.Now().UTC().Format("2006-01-02 15:04:05.000000")); err != nil {
+		return err
+	}
+
+	event.State, event.PublicFg, event.ClosedFg = to, public, closed
+	return nil
+}
+
+// updateSoldOut moves an event between on_sale and sold_out after its
+// inventory changed. Failures are only logged; the next change retries.
+func updateSoldOut(eventID int64) {
+	remains, err := inventory.Remains(eventID)
+	if err != nil {
+		return
+	}
+	total := 0
+	for _, n := range remains {
+		total += n
+	}
+
+	from, to := StateSoldOut, StateOnSale
+	if total == 0 {
+		from, to = StateOnSale, StateSoldOut
+	}
+
+	var state string
+	if err := db.QueryRow("SELECT state FROM events WHERE id = ?", eventID).Scan(&state); err != nil || state != from {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("update sold out:", err)
+		return
+	}
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ? FOR UPDATE", eventID), &event); err != nil || event.State != from {
+		tx.Rollback()
+		return
+	}
+	if err := transitionEvent(tx, &event, to, 0); err != nil {
+		tx.Rollback()
+		log.Println("update sold out:", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		log.Println("update sold out:", err)
+	}
+}
+
+func transitionEventByID(eventID int64, to string, administratorID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ? FOR UPDATE", eventID), &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := transitionEvent(tx, &event, to, administratorID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return nil
+}
+
+func transitionAdminEventHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		State string `json:"state"`
+	}
+	c.Bind(&params)
+
+	administrator, err := getLoginAdministrator(c)
+	if err != nil {
+		return err
+	}
+
+	if params.State == StateCanceled {
+		// Canceling refunds the reservations as well.
+		_, err = cancelEvent(eventID, administrator.ID)
+	} else {
+		err = transitionEventByID(eventID, params.State, administrator.ID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "not_found", 404)
+		}
+		if err == errInvalidTransition {
+			return resError(c, "invalid_transition", 400)
+		}
+		return err
+	}
+
+	e, err := getEvent(eventID, -1)
+	if err != nil {
+		return err
+	}
+	return c.JSON(200, e)
+}
+
+func getAdminEventTransitionsHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	rows, err := db.Query("SELECT id, event_id, from_state, to_state, IFNULL(administrator_id, 0), created_at FROM event_transitions WHERE event_id = ? ORDER BY id ASC", eventID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	transitions := make([]EventTransition, 0)
+	for rows.Next() {
+		var t EventTransition
+		if err := rows.Scan(&t.ID, &t.EventID, &t.FromState, &t.ToState, &t.AdministratorID, &t.CreatedAt); err != nil {
+			return err
+		}
+		t.CreatedAtUnix = t.CreatedAt.Unix()
+		transitions = append(transitions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, transitions)
+}
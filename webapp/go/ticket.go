@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errInvalidTicket = errors.New("ticket: invalid token")
+
+// ticketSecret signs ticket tokens. It is read from TICKET_SECRET, which is
+// required since the token format is public; changing it invalidates every
+// ticket issued so far. `make secrets` generates one per deployment into
+// webapp/secrets.env, which is kept out of the repository.
+var ticketSecret []byte
+
+func setTicketSecret() error {
+	v := os.Getenv("TICKET_SECRET")
+	if v == "" {
+		return errors.New("TICKET_SECRET is not set")
+	}
+	ticketSecret = []byte(v)
+	return nil
+}
+
+// Ticket is the content of a ticket token. It names the owner, so a token
+// stops being valid once the reservation is transferred or resold.
+type Ticket struct {
+	ReservationID int64
+	EventID       int64
+	UserID        int64
+}
+
+func ticketSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, ticketSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Token returns the ticket as "<payload>.<HMAC-SHA256>", both base64url
+// encoded, short and URL safe enough for a QR code.
+func (t *Ticket) Token() string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%d", t.ReservationID, t.EventID, t.UserID)))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(ticketSignature(payload))
+}
+
+// parseTicket verifies the signature of token and decodes its ticket.
+func parseTicket(token string) (*Ticket, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, errInvalidTicket
+	}
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, ticketSignature(payload)) {
+		return nil, errInvalidTicket
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidTicket
+	}
+	var t Ticket
+	if _, err := fmt.Sscanf(string(b), "%d:%d:%d", &t.ReservationID, &t.EventID, &t.UserID); err != nil {
+		return nil, errInvalidTicket
+	}
+	return &t, nil
+}
+
+// checkInAdminEventHandler admits the holder of a ticket token to the
+// event. Every ticket can be checked in once.
+func checkInAdminEventHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Token string `json:"token"`
+	}
+	c.Bind(&params)
+
+	ticket, err := parseTicket(params.Token)
+	if err != nil || ticket.EventID != eventID {
+		return resError(c, "invalid_ticket", 400)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var reservation Reservation
+	var checkedInAt *time.Time
+	if err := tx.QueryRow("SELECT "+reservationColumns+", checked_in_at FROM reservations WHERE id = ? AND event_id = ? FOR UPDATE", ticket.ReservationID, eventID).
+		Scan(append(reservation.columns(), &checkedInAt)...); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_ticket", 400)
+		}
+		return err
+	}
+	if reservation.CanceledAt != nil {
+		tx.Rollback()
+		return resError(c, "ticket_canceled", 409)
+	}
+	if reservation.UserID != ticket.UserID {
+		tx.Rollback()
+		return resError(c, "ticket_transferred", 409)
+	}
+	if checkedInAt != nil {
+		tx.Rollback()
+		return resError(c, "already_checked_in", 409)
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE reservations SET checked_in_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	sheet := getSheet(reservation.SheetID)
+	return c.JSON(200, echo.Map{
+		"reservation_id": reservation.ID,
+		"user_id":        reservation.UserID,
+		"sheet_rank":     sheet.Rank,
+		"sheet_num":      sheet.Num,
+		"checked_in_at":  now.Unix(),
+	})
+}
+
+// Attendance counts the active reservations of an event, overall or of a
+// rank, and how many of them were checked in.
+type Attendance struct {
+	Rank      string  `json:"rank,omitempty"`
+	Reserved  int64   `json:"reserved"`
+	CheckedIn int64   `json:"checked_in"`
+	Rate      float64 `json:"rate"`
+}
+
+func (a *Attendance) finish() {
+	if a.Reserved > 0 {
+		a.Rate = float64(a.CheckedIn) / float64(a.Reserved)
+	}
+}
+
+func getEventAttendanceHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM events WHERE id = ?", eventID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return resError(c, "not_found", 404)
+	}
+
+	rows, err := db.Query("SELECT s.`rank`, COUNT(*), COUNT(r.checked_in_at) FROM reservations r JOIN sheets s ON s.id = r.sheet_id "+
+		"WHERE r.event_id = ? AND r.canceled_at IS NULL GROUP BY s.`rank` ORDER BY s.`rank` ASC", eventID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var total Attendance
+	ranks := make([]*Attendance, 0)
+	for rows.Next() {
+		var a Attendance
+		if err := rows.Scan(&a.Rank, &a.Reserved, &a.CheckedIn); err != nil {
+			return err
+		}
+		a.finish()
+		total.Reserved += a.Reserved
+		total.CheckedIn += a.CheckedIn
+		ranks = append(ranks, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	total.finish()
+
+	return c.JSON(200, echo.Map{
+		"event_id": eventID,
+		"total":    total,
+		"ranks":    ranks,
+	})
+}
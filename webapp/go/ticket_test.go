@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTicketToken(t *testing.T) {
+	ticketSecret = []byte("test secret")
+	want := Ticket{ReservationID: 12, EventID: 3, UserID: 45}
+	token := want.Token()
+
+	got, err := parseTicket(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != want {
+		t.Fatalf("parseTicket = %+v, want %+v", *got, want)
+	}
+
+	i := strings.IndexByte(token, '.')
+	forged := (&Ticket{ReservationID: 13, EventID: 3, UserID: 45}).Token()
+	for _, bad := range []string{
+		"",
+		"garbage",
+		token[:i],
+		forged[:strings.IndexByte(forged, '.')] + token[i:],
+		token[:len(token)-2] + "AA",
+	} {
+		if _, err := parseTicket(bad); err != errInvalidTicket {
+			t.Errorf("parseTicket(%q) = %v, want errInvalidTicket", bad, err)
+		}
+	}
+
+	ticketSecret = []byte("another secret")
+	if _, err := parseTicket(token); err != errInvalidTicket {
+		t.Errorf("token verified with another secret: %v", err)
+	}
+}
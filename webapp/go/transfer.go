@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Transfer hands a reservation over to another user. It stays pending
+// until the recipient accepts it or either side withdraws it.
+type Transfer struct {
+	ID            int64      `json:"id"`
+	ReservationID int64      `json:"reservation_id"`
+	EventID       int64      `json:"event_id"`
+	SheetRank     string     `json:"sheet_rank"`
+	SheetNum      int64      `json:"sheet_num"`
+	FromUserID    int64      `json:"from_user_id"`
+	ToUserID      int64      `json:"to_user_id"`
+	CreatedAt     *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+// pendingTransferCondition matches the pending transfers of t whose
+// reservation is still active and owned by the sender. Any other pending
+// transfer can no longer be accepted.
+const pendingTransferCondition = "t.accepted_at IS NULL AND t.canceled_at IS NULL AND r.canceled_at IS NULL AND r.user_id = t.from_user_id"
+
+func addTransferHandler(c echo.Context) error {
+	var params struct {
+		LoginName string `json:"login_name"`
+	}
+	c.Bind(&params)
+
+	user, event, sheet, err := findOwnedSheet(c)
+	if event == nil {
+		return err
+	}
+
+	var recipientID int64
+	if err := db.QueryRow("SELECT id FROM users WHERE login_name = ?", params.LoginName).Scan(&recipientID); err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_recipient", 404)
+		}
+		return err
+	}
+	if recipientID == user.ID {
+		return resError(c, "invalid_recipient", 400)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	reservation, err := lockOwnedReservation(tx, event, sheet, user.ID)
+	if err != nil {
+		tx.Rollback()
+		return resOwnedReservationError(c, err)
+	}
+
+	var pending int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM reservation_transfers WHERE reservation_id = ? AND from_user_id = ? AND accepted_at IS NULL AND canceled_at IS NULL", reservation.ID, user.ID).Scan(&pending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if pending > 0 {
+		tx.Rollback()
+		return resError(c, "transfer_pending", 409)
+	}
+
+	now := time.Now().UTC()
+	res, err := tx.Exec("INSERT INTO reservation_transfers (reservation_id, from_user_id, to_user_id, created_at) VALUES (?, ?, ?, ?)",
+		reservation.ID, user.ID, recipientID, now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	transferID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return c.JSON(201, Transfer{
+		ID:            transferID,
+		ReservationID: reservation.ID,
+		EventID:       event.ID,
+		SheetRank:     sheet.Rank,
+		SheetNum:      sheet.Num,
+		FromUserID:    user.ID,
+		ToUserID:      recipientID,
+		CreatedAt:     &now,
+		CreatedAtUnix: now.Unix(),
+	})
+}
+
+// getTransfersHandler lists the pending transfers the login user sent or
+// received.
+func getTransfersHandler(c echo.Context) error {
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT t.id, t.reservation_id, r.event_id, r.sheet_id, t.from_user_id, t.to_user_id, t.created_at "+
+		"FROM reservation_transfers t JOIN reservations r ON r.id = t.reservation_id "+
+		"WHERE (t.from_user_id = ? OR t.to_user_id = ?) AND "+pendingTransferCondition+" ORDER BY t.id ASC", user.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	transfers := make([]Transfer, 0)
+	for rows.Next() {
+		var transfer Transfer
+		var sheetID int64
+		if err := rows.Scan(&transfer.ID, &transfer.ReservationID, &transfer.EventID, &sheetID, &transfer.FromUserID, &transfer.ToUserID, &transfer.CreatedAt); err != nil {
+			return err
+		}
+		sheet := getSheet(sheetID)
+		transfer.SheetRank = sheet.Rank
+		transfer.SheetNum = sheet.Num
+		transfer.CreatedAtUnix = transfer.CreatedAt.Unix()
+		transfers = append(transfers, transfer)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.JSON(200, transfers)
+}
+
+// acceptTransferHandler moves the reservation to the recipient. The
+// reservation keeps its sheet, price and reservation time.
+func acceptTransferHandler(c echo.Context) error {
+	transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "transfer_not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	var reservationID, fromUserID, toUserID int64
+	var acceptedAt, canceledAt *time.Time
+	if err := tx.QueryRow("SELECT reservation_id, from_user_id, to_user_id, accepted_at, canceled_at FROM reservation_transfers WHERE id = ? FOR UPDATE", transferID).
+		Scan(&reservationID, &fromUserID, &toUserID, &acceptedAt, &canceledAt); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return resError(c, "transfer_not_found", 404)
+		}
+		return err
+	}
+	if toUserID != user.ID || acceptedAt != nil || canceledAt != nil {
+		tx.Rollback()
+		return resError(c, "transfer_not_found", 404)
+	}
+
+	var reservation Reservation
+	if err := scanReservation(tx.QueryRow("SELECT "+reservationColumns+" FROM reservations WHERE id = ? FOR UPDATE", reservationID), &reservation); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if reservation.CanceledAt != nil || reservation.UserID != fromUserID {
+		tx.Rollback()
+		return resError(c, "transfer_expired", 410)
+	}
+
+	var event Event
+	if err := scanEvent(tx.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", reservation.EventID), &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := event.checkCancelable(time.Now()); err != nil {
+		tx.Rollback()
+		return resError(c, "event_started", 403)
+	}
+
+	sheet := getSheet(reservation.SheetID)
+	if err := checkPurchaseLimits(tx, &event, user.ID, []*Sheet{&sheet}); err != nil {
+		tx.Rollback()
+		if err == errLimitExceeded {
+			return resError(c, "limit_exceeded", 409)
+		}
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE reservation_transfers SET accepted_at = ? WHERE id = ?", now.Format("2006-01-02 15:04:05.000000"), transferID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := changeReservationOwner(tx, reservation.ID, user.ID, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return c.JSON(200, echo.Map{
+		"id":         reservation.ID,
+		"event_id":   reservation.EventID,
+		"sheet_rank": sheet.Rank,
+		"sheet_num":  sheet.Num,
+	})
+}
+
+// changeReservationOwner moves the reservation locked in tx to userID. The
+// transfers still pending and the resale listings still open were offered
+// by the previous owner and are withdrawn, so that they cannot be taken up
+// should the reservation ever come back to that owner.
+func changeReservationOwner(tx *sql.Tx, reservationID, userID int64, now time.Time) error {
+	if _, err := tx.Exec("UPDATE reservations SET user_id = ? WHERE id = ?", userID, reservationID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE reservation_transfers SET canceled_at = ? WHERE reservation_id = ? AND accepted_at IS NULL AND canceled_at IS NULL",
+		now.Format("2006-01-02 15:04:05.000000"), reservationID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE resale_listings SET canceled_at = ? WHERE reservation_id = ? AND sold_at IS NULL AND canceled_at IS NULL",
+		now.Format("2006-01-02 15:04:05.000000"), reservationID)
+	return err
+}
+
+// removeTransferHandler withdraws a pending transfer. The sender cancels
+// it and the recipient declines it the same way.
+func removeTransferHandler(c echo.Context) error {
+	transferID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "transfer_not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("UPDATE reservation_transfers SET canceled_at = ? WHERE id = ? AND (from_user_id = ? OR to_user_id = ?) AND accepted_at IS NULL AND canceled_at IS NULL",
+		time.Now().UTC().Format("2006-01-02 15:04:05.000000"), transferID, user.ID, user.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "transfer_not_found", 404)
+	}
+	return c.NoContent(204)
+}
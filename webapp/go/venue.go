@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultVenueID is the hall the original S/A/B/C sheets belong to.
+const defaultVenueID = 1
+
+// Venue is a hall with its own seat layout. Every event takes place in one
+// venue and its Event.Sheets are derived from the venue's ranks.
+type Venue struct {
+	ID    int64        `json:"id"`
+	Name  string       `json:"name"`
+	Total int          `json:"total"`
+	Ranks []*VenueRank `json:"ranks"`
+}
+
+// VenueRank is one rank of a venue layout. Price is the surcharge added to
+// the event's base price.
+type VenueRank struct {
+	Rank  string `json:"rank"`
+	Total int    `json:"total"`
+	Price int64  `json:"price"`
+
+	sheets []*Sheet
+}
+
+var (
+	venuesMu sync.RWMutex
+	venues   map[int64]*Venue
+	sheets   map[int64]Sheet
+)
+
+func getVenue(venueID int64) (*Venue, bool) {
+	venuesMu.RLock()
+	defer venuesMu.RUnlock()
+	v, ok := venues[venueID]
+	return v, ok
+}
+
+// anyVenueHasRank reports whether rank is a rank of some venue.
+func anyVenueHasRank(rank string) bool {
+	venuesMu.RLock()
+	defer venuesMu.RUnlock()
+	for _, v := range venues {
+		if _, ok := v.Rank(rank); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func getVenues() []*Venue {
+	venuesMu.RLock()
+	defer venuesMu.RUnlock()
+	list := make([]*Venue, 0, len(venues))
+	for _, v := range venues {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func getSheet(sheetID int64) Sheet {
+	venuesMu.RLock()
+	defer venuesMu.RUnlock()
+	return sheets[sheetID]
+}
+
+func (v *Venue) Rank(rank string) (*VenueRank, bool) {
+	for _, r := range v.Ranks {
+		if r.Rank == rank {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func (v *Venue) Sheet(rank string, num int64) (*Sheet, bool) {
+	r, ok := v.Rank(rank)
+	if !ok {
+		return nil, false
+	}
+	i := sort.Search(len(r.sheets), func(i int) bool { return r.sheets[i].Num >= num })
+	if i == len(r.sheets) || r.sheets[i].Num != num {
+		return nil, false
+	}
+	return r.sheets[i], true
+}
+
+// setVenues loads every venue and its sheets into memory.
+func setVenues() error {
+	loaded := map[int64]*Venue{}
+	loadedSheets := map[int64]Sheet{}
+
+	rows, err := db.Query("SELECT id, name FROM venues")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		v := &Venue{}
+		if err := rows.Scan(&v.ID, &v.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		loaded[v.ID] = v
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query("SELECT id, venue_id, `rank`, num, price FROM sheets ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Sheet
+		var venueID int64
+		if err := rows.Scan(&s.ID, &venueID, &s.Rank, &s.Num, &s.Price); err != nil {
+			return err
+		}
+		loadedSheets[s.ID] = s
+
+		v, ok := loaded[venueID]
+		if !ok {
+			continue
+		}
+		r, ok := v.Rank(s.Rank)
+		if !ok {
+			r = &VenueRank{Rank: s.Rank, Price: s.Price}
+			v.Ranks = append(v.Ranks, r)
+		}
+		r.sheets = append(r.sheets, &s)
+		r.Total++
+		v.Total++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range loaded {
+		for _, r := range v.Ranks {
+			sort.Slice(r.sheets, func(i, j int) bool { return r.sheets[i].Num < r.sheets[j].Num })
+		}
+	}
+
+	venuesMu.Lock()
+	venues = loaded
+	sheets = loadedSheets
+	venuesMu.Unlock()
+	return nil
+}
+
+var rankPattern = regexp.MustCompile(`^[0-9A-Za-z_-]{1,16}$`)
+
+const maxSheetsPerRank = 10000
+
+func getAdminVenuesHandler(c echo.Context) error {
+	return c.JSON(200, getVenues())
+}
+
+func getAdminVenueHandler(c echo.Context) error {
+	venueID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	venue, ok := getVenue(venueID)
+	if !ok {
+		return resError(c, "not_found", 404)
+	}
+	return c.JSON(200, venue)
+}
+
+func addAdminVenueHandler(c echo.Context) error {
+	var params struct {
+		Name  string `json:"name"`
+		Ranks []struct {
+			Rank  string `json:"rank"`
+			Total int    `json:"total"`
+			Price int64  `json:"price"`
+		} `json:"ranks"`
+	}
+	c.Bind(&params)
+
+	if params.Name == "" {
+		return resError(c, "invalid_name", 400)
+	}
+	if len(params.Ranks) == 0 {
+		return resError(c, "invalid_layout", 400)
+	}
+	seen := map[string]bool{}
+	for _, r := range params.Ranks {
+		if !rankPattern.MatchString(r.Rank) || seen[r.Rank] {
+			return resError(c, "invalid_rank", 400)
+		}
+		if r.Total <= 0 || r.Total > maxSheetsPerRank || r.Price < 0 {
+			return resError(c, "invalid_layout", 400)
+		}
+		seen[r.Rank] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO venues (name) VALUES (?)", params.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	venueID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, r := range params.Ranks {
+		placeholders := make([]string, 0, r.Total)
+		args := make([]interface{}, 0, r.Total*4)
+		for num := 1; num <= r.Total; num++ {
+			placeholders = append(placeholders, "(?, ?, ?, ?)")
+			args = append(args, venueID, r.Rank, num, r.Price)
+		}
+		if _, err := tx.Exec("INSERT INTO sheets (venue_id, `rank`, num, price) VALUES "+strings.Join(placeholders, ", "), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := setVenues(); err != nil {
+		return err
+	}
+	venue, ok := getVenue(venueID)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	return c.JSON(200, venue)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+var errAlreadyWaiting = errors.New("waitlist: already waiting")
+
+// WaitlistEntry is a user waiting for a sheet of a sold-out rank. Position
+// is 1 for the user who gets the next freed sheet.
+type WaitlistEntry struct {
+	ID        int64      `json:"id"`
+	EventID   int64      `json:"event_id"`
+	Rank      string     `json:"sheet_rank"`
+	Position  int        `json:"position"`
+	CreatedAt *time.Time `json:"-"`
+
+	CreatedAtUnix int64 `json:"created_at"`
+}
+
+// promoteWaitlist gives a freed sheet to the first user waiting for its
+// rank by reserving it for them in tx. It reports whether the sheet was
+// handed over; if not, the caller must release it in the inventory.
+func promoteWaitlist(tx *sql.Tx, event *Event, sheet *Sheet) (bool, error) {
+	event, err := lockSellingEvent(tx, event, time.Now())
+	switch err {
+	case nil:
+	case errEventHidden, errSalesPaused, errSalesNotOpen, errSalesClosed:
+		return false, nil
+	default:
+		return false, err
+	}
+
+	rows, err := tx.Query("SELECT id, user_id FROM waitlists WHERE event_id = ? AND `rank` = ? AND reservation_id IS NULL ORDER BY id ASC FOR UPDATE", event.ID, sheet.Rank)
+	if err != nil {
+		return false, err
+	}
+	var entries [][2]int64
+	for rows.Next() {
+		var entry [2]int64
+		if err := rows.Scan(&entry[0], &entry[1]); err != nil {
+			rows.Close()
+			return false, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	// Users who reached the purchase limit keep their place in the queue.
+	var entryID, userID int64
+	for _, entry := range entries {
+		err := checkPurchaseLimits(tx, event, entry[1], []*Sheet{sheet})
+		if err == errLimitExceeded {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		entryID, userID = entry[0], entry[1]
+		break
+	}
+	if entryID == 0 {
+		return false, nil
+	}
+
+	pricer, err := newPricer(tx, event)
+	if err != nil {
+		return false, err
+	}
+	remains, err := inventory.Remains(event.ID)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	charge := Charge{Price: pricer.Price(sheet.Rank, sheet.Price, remains[sheet.Rank]+1, now)}
+	reservationID, err := insertReservation(tx, event, userID, sheet, charge, now)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE waitlists SET reservation_id = ?, promoted_at = ? WHERE id = ?", reservationID, now.Format("2006-01-02 15:04:05.000000"), entryID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseSheets offers sheets that are no longer held to the waitlist and
+// returns the ones nobody was waiting for to the inventory.
+func releaseSheets(eventID int64, sheets []*Sheet) {
+	var event Event
+	if err := scanEvent(db.QueryRow("SELECT "+eventColumns+" FROM events WHERE id = ?", eventID), &event); err != nil {
+		log.Println("release sheets:", err)
+		inventory.ReleaseAll(eventID, sheets)
+		return
+	}
+
+	for _, sheet := range sheets {
+		promoted, err := promoteWaitlistTx(&event, sheet)
+		if err != nil {
+			log.Println("promote waitlist:", err)
+		}
+		if !promoted || err != nil {
+			inventory.Release(eventID, sheet)
+		}
+	}
+	updateSoldOut(eventID)
+}
+
+func promoteWaitlistTx(event *Event, sheet *Sheet) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	promoted, err := promoteWaitlist(tx, event, sheet)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return promoted, nil
+}
+
+func getUserWaitlist(userID int64) ([]WaitlistEntry, error) {
+	rows, err := db.Query("SELECT w.id, w.event_id, w.`rank`, w.created_at, "+
+		"(SELECT COUNT(*) FROM waitlists w2 WHERE w2.event_id = w.event_id AND w2.`rank` = w.`rank` AND w2.reservation_id IS NULL AND w2.id <= w.id) "+
+		"FROM waitlists w WHERE w.user_id = ? AND w.reservation_id IS NULL ORDER BY w.id ASC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]WaitlistEntry, 0)
+	for rows.Next() {
+		var entry WaitlistEntry
+		if err := rows.Scan(&entry.ID, &entry.EventID, &entry.Rank, &entry.CreatedAt, &entry.Position); err != nil {
+			return nil, err
+		}
+		entry.CreatedAtUnix = entry.CreatedAt.Unix()
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// insertWaitlistEntry queues the user for a sheet of rank. The unique key
+// on waiting entries refuses a second one, even from concurrent requests.
+func insertWaitlistEntry(eventID int64, rank string, userID int64, now time.Time) (int64, error) {
+	res, err := db.Exec("INSERT INTO waitlists (event_id, `rank`, user_id, created_at) VALUES (?, ?, ?, ?)",
+		eventID, rank, userID, now.Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		if myErr, ok := err.(*mysql.MySQLError); ok && myErr.Number == 1062 {
+			return 0, errAlreadyWaiting
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func addWaitlistHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+	var params struct {
+		Rank string `json:"sheet_rank"`
+	}
+	c.Bind(&params)
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	event, err := getEvent(eventID, user.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return resError(c, "invalid_event", 404)
+		}
+		return err
+	} else if !event.visible() {
+		return resError(c, "invalid_event", 404)
+	}
+
+	if !validateRank(event, params.Rank) {
+		return resError(c, "invalid_rank", 400)
+	}
+
+	if err := event.checkSelling(time.Now()); err != nil {
+		return resSalesWindowError(c, err)
+	}
+	if event.Sheets[params.Rank].Remains > 0 {
+		return resError(c, "not_sold_out", 400)
+	}
+
+	now := time.Now().UTC()
+	entryID, err := insertWaitlistEntry(event.ID, params.Rank, user.ID, now)
+	if err != nil {
+		if err == errAlreadyWaiting {
+			return resError(c, "duplicated", 409)
+		}
+		return err
+	}
+
+	entry := WaitlistEntry{
+		ID:            entryID,
+		EventID:       event.ID,
+		Rank:          params.Rank,
+		CreatedAt:     &now,
+		CreatedAtUnix: now.Unix(),
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM waitlists WHERE event_id = ? AND `rank` = ? AND reservation_id IS NULL AND id <= ?", event.ID, params.Rank, entryID).Scan(&entry.Position); err != nil {
+		return err
+	}
+	return c.JSON(201, entry)
+}
+
+func removeWaitlistHandler(c echo.Context) error {
+	eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return resError(c, "not_found", 404)
+	}
+
+	user, err := getLoginUser(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM waitlists WHERE event_id = ? AND `rank` = ? AND user_id = ? AND reservation_id IS NULL", eventID, c.Param("rank"), user.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return resError(c, "not_waiting", 404)
+	}
+	return c.NoContent(204)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentWaitlistEntriesAreUnique checks that concurrent requests
+// queue a user only once per rank, and that a promoted entry does not keep
+// the user from waiting again.
+func TestConcurrentWaitlistEntriesAreUnique(t *testing.T) {
+	openTestDB(t)
+	event := addTestEvent(t)
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM waitlists WHERE event_id = ?", event.ID)
+	})
+
+	const workers = 16
+	var wg sync.WaitGroup
+	ids := make(chan int64, workers)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := insertWaitlistEntry(event.ID, "S", 1, time.Now().UTC())
+			if err == nil {
+				ids <- id
+			} else if err != errAlreadyWaiting {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("%d waiting entries for one user, want 1", len(ids))
+	}
+
+	if _, err := db.Exec("UPDATE waitlists SET reservation_id = 1 WHERE id = ?", <-ids); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertWaitlistEntry(event.ID, "S", 1, time.Now().UTC()); err != nil {
+		t.Fatalf("waiting again after promotion: %v", err)
+	}
+}